@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"time"
+)
+
+// changeTracker compares the assets of a new snapshot to those of the
+// previous one while they are written, one at a time. Of the previous
+// assets, it only keeps what the changelog shows.
+type changeTracker struct {
+	changes models.Changes
+	known   map[string]knownAsset
+	order   []string // the GameIds of known, in the order of the previous snapshot
+	current map[string]bool
+}
+
+// knownAsset is what a changeTracker remembers of a previous asset.
+type knownAsset struct {
+	ref         models.AssetRef
+	description string
+	firstSeenAt *time.Time
+}
+
+func newChangeTracker(now time.Time) *changeTracker {
+	return &changeTracker{
+		changes: models.Changes{ComputedAt: now},
+		known:   make(map[string]knownAsset),
+		current: make(map[string]bool),
+	}
+}
+
+// loadChangeTracker starts tracking the changes of a new snapshot against
+// the current one. It returns nil if there is no current snapshot.
+func loadChangeTracker(ctx context.Context, snapshotId string) (*changeTracker, error) {
+	manifest, err := storage.GetManifest(ctx)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := newChangeTracker(time.Now().UTC())
+	t.changes.SnapshotId = snapshotId
+	t.changes.PreviousSnapshotId = manifest.SnapshotId
+	err = storage.EachAsset(ctx, manifest.SnapshotId, func(asset models.Asset) error {
+		t.addPrevious(asset)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// addPrevious adds an asset of the previous snapshot.
+func (t *changeTracker) addPrevious(asset models.Asset) {
+	if _, ok := t.known[asset.GameId]; !ok {
+		t.order = append(t.order, asset.GameId)
+	}
+	t.known[asset.GameId] = knownAsset{
+		ref:         assetRef(asset),
+		description: asset.Description,
+		firstSeenAt: asset.FirstSeenAt,
+	}
+}
+
+// add compares an asset of the new snapshot to the previous one. Assets
+// that were already known keep their FirstSeenAt, new ones are stamped with
+// the time the changes are computed at.
+func (t *changeTracker) add(asset *models.Asset) {
+	old, ok := t.known[asset.GameId]
+	if ok {
+		asset.FirstSeenAt = old.firstSeenAt
+	} else {
+		asset.FirstSeenAt = &t.changes.ComputedAt
+	}
+	// an asset can be listed twice if the listing shifted during the crawl,
+	// but is only one change
+	if t.current[asset.GameId] {
+		return
+	}
+	t.current[asset.GameId] = true
+	if !ok {
+		t.changes.Added = append(t.changes.Added, assetRef(*asset))
+		return
+	}
+	if fields := editedFields(old, *asset); len(fields) > 0 {
+		t.changes.Edited = append(t.changes.Edited, models.AssetEdit{AssetRef: assetRef(*asset), Fields: fields})
+	}
+}
+
+// finish returns the changes, with every previous asset that was not added
+// to the new snapshot as removed.
+func (t *changeTracker) finish() models.Changes {
+	changes := t.changes
+	changes.Removed = nil
+	for _, gameId := range t.order {
+		if !t.current[gameId] {
+			changes.Removed = append(changes.Removed, t.known[gameId].ref)
+		}
+	}
+	return changes
+}
+
+// editedFields lists the changes of the fields of an asset that are shown
+// in the changelog.
+func editedFields(old knownAsset, new models.Asset) []models.FieldChange {
+	var fields []models.FieldChange
+	check := func(field, oldValue, newValue string) {
+		if oldValue != newValue {
+			fields = append(fields, models.FieldChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	check("Title", old.ref.Title, new.Title)
+	check("Author", old.ref.Author, new.Author)
+	check("Description", old.description, new.Description)
+	return fields
+}
+
+func assetRef(asset models.Asset) models.AssetRef {
+	return models.AssetRef{GameId: asset.GameId, Title: asset.Title, Author: asset.Author, Link: asset.Link}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"itchgrep/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeTracker(t *testing.T) {
+	firstSeen := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)
+	previous := []models.Asset{
+		{GameId: "1", Title: "Bones", Author: "a", FirstSeenAt: &firstSeen},
+		{GameId: "2", Title: "Trees", Author: "b"},
+		{GameId: "3", Title: "Rocks", Author: "c"},
+		{GameId: "3", Title: "Rocks", Author: "c"},
+	}
+	assets := []models.Asset{
+		{GameId: "4", Title: "Swords", Author: "d"},
+		{GameId: "1", Title: "Bones", Author: "a"},
+		{GameId: "2", Title: "Trees 2", Author: "b", Description: "now with pines"},
+		{GameId: "4", Title: "Swords", Author: "d"}, // listed twice
+	}
+
+	tracker := newChangeTracker(now)
+	for _, asset := range previous {
+		tracker.addPrevious(asset)
+	}
+	for i := range assets {
+		tracker.add(&assets[i])
+	}
+	changes := tracker.finish()
+	assert.Equal(t, []models.AssetRef{{GameId: "4", Title: "Swords", Author: "d"}}, changes.Added)
+	assert.Equal(t, []models.AssetRef{{GameId: "3", Title: "Rocks", Author: "c"}}, changes.Removed)
+	require.Len(t, changes.Edited, 1)
+	assert.Equal(t, "2", changes.Edited[0].GameId)
+	assert.Equal(t, []models.FieldChange{
+		{Field: "Title", Old: "Trees", New: "Trees 2"},
+		{Field: "Description", Old: "", New: "now with pines"},
+	}, changes.Edited[0].Fields)
+
+	assert.Equal(t, &now, assets[0].FirstSeenAt, "new assets are first seen now")
+	assert.Equal(t, &firstSeen, assets[1].FirstSeenAt, "known assets keep when they were first seen")
+	assert.Nil(t, assets[2].FirstSeenAt, "assets of the first snapshot stay unknown")
+	assert.Equal(t, &now, assets[3].FirstSeenAt)
+}
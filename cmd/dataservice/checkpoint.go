@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is how often the progress of a running crawl is saved.
+const checkpointInterval = 30 * time.Second
+
+// checkpointMaxAge is how old a checkpoint may be to still be resumed. Older
+// ones describe a catalogue that has changed too much in the meantime.
+const checkpointMaxAge = 24 * time.Hour
+
+// errCancelledByAdmin is the cause given when a crawl is cancelled on
+// purpose. Unlike a shutdown, this also throws away its checkpoint.
+var errCancelledByAdmin = errors.New("crawl cancelled by admin")
+
+// newRunId returns a unique, chronologically sortable ID for a crawl.
+func newRunId() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// checkpointer keeps track of the progress of a full crawl and saves it to
+// storage periodically, so that an interrupted run can be resumed. A listing
+// page only counts as completed once all of its assets were written to the
+// snapshot. The written assets are appended to a local part file, which is
+// uploaded next to the checkpoint when it is saved, so the checkpointer only
+// holds the assets that are still in the pipeline.
+type checkpointer struct {
+	mu         sync.Mutex
+	checkpoint models.CrawlCheckpoint
+	pending    map[string]pageRef // GameIds in the pipeline, by the page they are from
+	remaining  map[pageRef]int    // how many assets of each page are in the pipeline
+	dirty      bool
+	stop       chan bool
+	done       chan bool
+
+	dir      string // local directory of the parts, created when first needed
+	part     *os.File
+	partOut  *bufio.Writer
+	partSize int              // assets in part
+	unsaved  []checkpointPart // parts that are not stored yet, the oldest first
+	err      error            // set once a part could not be written
+
+	throwaway bool // never stored, see newThrowawayCheckpointer
+}
+
+// pageRef names a listing page of a source.
+type pageRef struct {
+	source  string
+	pageNum int64
+}
+
+// checkpointPart is a local file with a part of the written assets.
+type checkpointPart struct {
+	num  int
+	path string
+}
+
+func newCheckpointer(checkpoint models.CrawlCheckpoint) *checkpointer {
+	return &checkpointer{
+		checkpoint: checkpoint,
+		pending:    make(map[string]pageRef),
+		remaining:  make(map[pageRef]int),
+	}
+}
+
+// newThrowawayCheckpointer returns a checkpointer for a new run that is never
+// stored, for crawls that must not touch the checkpoints of other runs.
+func newThrowawayCheckpointer(runId string) *checkpointer {
+	c := newCheckpointer(newRunCheckpoint(runId))
+	c.throwaway = true
+	return c
+}
+
+// newRunCheckpoint returns the empty checkpoint of a new run.
+func newRunCheckpoint(runId string) models.CrawlCheckpoint {
+	now := time.Now().UTC()
+	return models.CrawlCheckpoint{
+		RunId:     runId,
+		Mode:      modeFull,
+		StartedAt: now,
+		UpdatedAt: now,
+		Sources:   make(map[string]*models.SourceProgress),
+	}
+}
+
+// resumeOrStartCheckpoint picks up the newest unfinished run from storage, or
+// starts a new one under runId if there is none that is recent enough. Only
+// runs that crawled nothing but the given sources are resumed, so that a
+// source that was removed since is not published. A resumed checkpoint keeps
+// the ID of the run that started it.
+func resumeOrStartCheckpoint(ctx context.Context, runId string, sourceNames []string) *checkpointer {
+	runIds, err := storage.ListCheckpoints(ctx)
+	if err != nil {
+		logging.Warning("Failed to list checkpoints, starting a new run: %v", err)
+	}
+	for i := len(runIds) - 1; i >= 0; i-- {
+		checkpoint, err := storage.GetCheckpoint(ctx, runIds[i])
+		if err != nil {
+			logging.Warning("Failed to read checkpoint %s: %v", runIds[i], err)
+			continue
+		}
+		if time.Since(checkpoint.UpdatedAt) > checkpointMaxAge {
+			logging.Info("Deleting stale checkpoint %s from %v", runIds[i], checkpoint.UpdatedAt)
+			storage.DeleteCheckpoint(ctx, runIds[i])
+			continue
+		}
+		if checkpoint.Sources == nil {
+			// written before there were sources, the pages are unknown
+			logging.Info("Deleting outdated checkpoint %s", runIds[i])
+			storage.DeleteCheckpoint(ctx, runIds[i])
+			continue
+		}
+		if removed := removedSources(checkpoint, sourceNames); len(removed) > 0 {
+			logging.Info("Deleting checkpoint %s, its sources %v are no longer crawled", runIds[i], removed)
+			storage.DeleteCheckpoint(ctx, runIds[i])
+			continue
+		}
+		c := newCheckpointer(checkpoint)
+		logging.Info("Resuming run %s: %d pages done, their assets are in %d parts",
+			checkpoint.RunId, c.completedPages(), checkpoint.AssetParts)
+		return c
+	}
+
+	return newCheckpointer(newRunCheckpoint(runId))
+}
+
+// removedSources returns the sources checkpoint has progress of that are not
+// among sourceNames.
+func removedSources(checkpoint models.CrawlCheckpoint, sourceNames []string) []string {
+	var removed []string
+	for name := range checkpoint.Sources {
+		if !slices.Contains(sourceNames, name) {
+			removed = append(removed, name)
+		}
+	}
+	slices.Sort(removed)
+	return removed
+}
+
+// resumed reports whether the run was picked up from an earlier attempt.
+func (c *checkpointer) resumed() bool {
+	return c.completedPages() > 0
+}
+
+// completedPages returns the number of pages done over all sources.
+func (c *checkpointer) completedPages() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	completed := 0
+	for _, progress := range c.checkpoint.Sources {
+		completed += len(progress.CompletedPages)
+	}
+	return completed
+}
+
+func (c *checkpointer) runId() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoint.RunId
+}
+
+// progress returns the progress of source, which the caller must hold c.mu
+// for.
+func (c *checkpointer) progress(source string) *models.SourceProgress {
+	progress, ok := c.checkpoint.Sources[source]
+	if !ok {
+		progress = &models.SourceProgress{}
+		c.checkpoint.Sources[source] = progress
+	}
+	return progress
+}
+
+func (c *checkpointer) pagesTotal(source string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.progress(source).PagesTotal
+}
+
+func (c *checkpointer) setPagesTotal(source string, pagesTotal int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress(source).PagesTotal = pagesTotal
+	c.dirty = true
+}
+
+// remainingPages returns the pages of 1..PagesTotal of source that are not
+// done yet.
+func (c *checkpointer) remainingPages(source string) []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	progress := c.progress(source)
+	completed := make(map[int64]bool, len(progress.CompletedPages))
+	for _, pageNum := range progress.CompletedPages {
+		completed[pageNum] = true
+	}
+	var remaining []int64
+	for pageNum := int64(1); pageNum <= progress.PagesTotal; pageNum++ {
+		if !completed[pageNum] {
+			remaining = append(remaining, pageNum)
+		}
+	}
+	return remaining
+}
+
+// eachAsset calls fn for every asset that an earlier attempt of the run
+// wrote, one at a time. It stops at the first error fn returns.
+func (c *checkpointer) eachAsset(ctx context.Context, fn func(models.Asset) error) error {
+	c.mu.Lock()
+	runId, parts := c.checkpoint.RunId, c.checkpoint.AssetParts
+	c.mu.Unlock()
+	for part := 0; part < parts; part++ {
+		if err := storage.EachCheckpointAsset(ctx, runId, part, fn); err != nil {
+			return fmt.Errorf("failed to read part %d of the assets: %w", part, err)
+		}
+	}
+	return nil
+}
+
+// pageFetched records the assets of a listing page that were handed to the
+// pipeline. The page is completed once all of them were written. Like every
+// method that records progress, it does nothing on a nil checkpointer, which
+// is used by crawls that are not resumable.
+func (c *checkpointer) pageFetched(source string, pageNum int64, gameIds []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page := pageRef{source: source, pageNum: pageNum}
+	if len(gameIds) == 0 {
+		c.pageDone(page)
+		return
+	}
+	c.remaining[page] += len(gameIds)
+	for _, gameId := range gameIds {
+		c.pending[gameId] = page
+	}
+}
+
+// written records an asset that was written to the snapshot, completing the
+// page it is from if it was the last one. Assets of an earlier attempt are
+// already stored and are ignored.
+func (c *checkpointer) written(asset models.Asset) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, ok := c.pending[asset.GameId]
+	if !ok {
+		return
+	}
+	delete(c.pending, asset.GameId)
+	if c.err != nil || c.throwaway {
+		return // no page can be completed anymore
+	}
+	if err := c.appendToPart(asset); err != nil {
+		c.fail(err)
+		return
+	}
+	if c.remaining[page]--; c.remaining[page] == 0 {
+		delete(c.remaining, page)
+		c.pageDone(page)
+	}
+}
+
+// pageDone completes a page, which the caller must hold c.mu for.
+func (c *checkpointer) pageDone(page pageRef) {
+	progress := c.progress(page.source)
+	progress.CompletedPages = append(progress.CompletedPages, page.pageNum)
+	c.dirty = true
+}
+
+// appendToPart adds an asset to the local part file, which the caller must
+// hold c.mu for.
+func (c *checkpointer) appendToPart(asset models.Asset) error {
+	data, err := json.Marshal(asset)
+	if err != nil {
+		return fmt.Errorf("failed to encode asset %s: %w", asset.GameId, err)
+	}
+	if c.part == nil {
+		if c.dir == "" {
+			if c.dir, err = os.MkdirTemp("", "checkpoint-*"); err != nil {
+				return err
+			}
+		}
+		c.part, err = os.Create(filepath.Join(c.dir, fmt.Sprintf("assets-%04d.json", c.checkpoint.AssetParts)))
+		if err != nil {
+			return err
+		}
+		c.partOut = bufio.NewWriter(c.part)
+		c.partOut.WriteString("[")
+	}
+	if c.partSize > 0 {
+		c.partOut.WriteString(",")
+	}
+	if _, err := c.partOut.Write(data); err != nil {
+		return err
+	}
+	c.partSize++
+	return nil
+}
+
+// closePart finishes the local part file, if there is one, to be stored with
+// the next save. The caller must hold c.mu.
+func (c *checkpointer) closePart() error {
+	if c.part == nil {
+		return nil
+	}
+	c.partOut.WriteString("]")
+	err := c.partOut.Flush()
+	if closeErr := c.part.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	c.unsaved = append(c.unsaved, checkpointPart{num: c.checkpoint.AssetParts, path: c.part.Name()})
+	c.checkpoint.AssetParts++
+	c.part, c.partOut, c.partSize = nil, nil, 0
+	return nil
+}
+
+// fail stops saving the checkpoint, since the assets of the pages completed
+// from now on can not be stored. The last saved checkpoint stays valid. The
+// caller must hold c.mu.
+func (c *checkpointer) fail(err error) {
+	logging.Warning("Failed to write the assets of the checkpoint of run %s, no longer saving it: %v",
+		c.checkpoint.RunId, err)
+	c.err = err
+}
+
+// facetPageDone records which assets were found on a page of a facet
+// listing.
+func (c *checkpointer) facetPageDone(source facetSource, pageNum int64, assets []models.Asset) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	progress := c.progress(source.Name())
+	progress.CompletedPages = append(progress.CompletedPages, pageNum)
+	if c.checkpoint.FacetMembers == nil {
+		c.checkpoint.FacetMembers = make(map[string][]string)
+	}
+	for _, asset := range assets {
+		c.checkpoint.FacetMembers[source.facet] = append(c.checkpoint.FacetMembers[source.facet], asset.GameId)
+	}
+	c.dirty = true
+}
+
+// facetMembers returns the GameIds found under each facet listing so far.
+func (c *checkpointer) facetMembers() map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members := make(map[string][]string, len(c.checkpoint.FacetMembers))
+	for facet, gameIds := range c.checkpoint.FacetMembers {
+		members[facet] = append([]string(nil), gameIds...)
+	}
+	return members
+}
+
+// save stores the parts of the assets that are not stored yet and then the
+// checkpoint, if anything changed since the last save. Saves must not run at
+// the same time.
+func (c *checkpointer) save(ctx context.Context) {
+	c.mu.Lock()
+	if !c.dirty || c.err != nil || c.throwaway {
+		c.mu.Unlock()
+		return
+	}
+	if err := c.closePart(); err != nil {
+		c.fail(err)
+		c.mu.Unlock()
+		return
+	}
+	c.checkpoint.UpdatedAt = time.Now().UTC()
+	checkpoint := c.checkpoint
+	checkpoint.Sources = make(map[string]*models.SourceProgress, len(c.checkpoint.Sources))
+	completedPages := 0
+	for name, progress := range c.checkpoint.Sources {
+		checkpoint.Sources[name] = &models.SourceProgress{
+			PagesTotal:     progress.PagesTotal,
+			CompletedPages: append([]int64(nil), progress.CompletedPages...),
+		}
+		completedPages += len(progress.CompletedPages)
+	}
+	checkpoint.FacetMembers = make(map[string][]string, len(c.checkpoint.FacetMembers))
+	for facet, gameIds := range c.checkpoint.FacetMembers {
+		checkpoint.FacetMembers[facet] = append([]string(nil), gameIds...)
+	}
+	parts := append([]checkpointPart(nil), c.unsaved...)
+	c.dirty = false
+	c.mu.Unlock()
+
+	// the checkpoint must not point at parts that are not stored
+	var err error
+	for _, part := range parts {
+		if err = storage.PutCheckpointAssetsFile(ctx, checkpoint.RunId, part.num, part.path); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = storage.PutCheckpoint(ctx, checkpoint)
+	}
+	if err != nil {
+		logging.Warning("Failed to save checkpoint of run %s: %v", checkpoint.RunId, err)
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return
+	}
+
+	c.mu.Lock()
+	c.unsaved = c.unsaved[len(parts):]
+	c.mu.Unlock()
+	for _, part := range parts {
+		os.Remove(part.path)
+	}
+	logging.Info("Saved checkpoint of run %s: %d pages, %d parts of assets",
+		checkpoint.RunId, completedPages, checkpoint.AssetParts)
+}
+
+// start saves the checkpoint every checkpointInterval until finish is called.
+func (c *checkpointer) start() {
+	c.stop = make(chan bool)
+	c.done = make(chan bool)
+	go func() {
+		defer close(c.done)
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(checkpointInterval):
+				// saving must not depend on the crawl context, or the last
+				// progress before a shutdown would be lost
+				saveCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				c.save(saveCtx)
+				cancel()
+			}
+		}
+	}()
+}
+
+// finish stops the periodic saving and saves the remaining progress, so
+// that the next trigger can resume the run if it is cancelled or fails to
+// publish. A run that was cancelled on purpose has its checkpoint thrown
+// away instead.
+func (c *checkpointer) finish(ctx context.Context) {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop = nil
+	}
+	defer c.removeParts()
+
+	saveCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if errors.Is(context.Cause(ctx), errCancelledByAdmin) {
+		c.discard(saveCtx)
+		return
+	}
+	c.save(saveCtx)
+}
+
+// discard removes the checkpoint from storage, once the run was published or
+// abandoned.
+func (c *checkpointer) discard(ctx context.Context) {
+	if c.throwaway {
+		return
+	}
+	runId := c.runId()
+	if err := storage.DeleteCheckpoint(ctx, runId); err != nil {
+		logging.Warning("Failed to delete checkpoint of run %s: %v", runId, err)
+	}
+}
+
+// removeParts removes the local parts of the assets, which are stored or no
+// longer needed once the crawl is over.
+func (c *checkpointer) removeParts() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.part != nil {
+		c.part.Close()
+		c.part, c.partOut, c.partSize = nil, nil, 0
+	}
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+		c.dir = ""
+	}
+	c.unsaved = nil
+}
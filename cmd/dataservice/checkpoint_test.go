@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeOrStartCheckpoint(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+	sourceNames := []string{"facet:free", "itch"}
+
+	c := resumeOrStartCheckpoint(ctx, "run-new", sourceNames)
+	assert.Equal(t, "run-new", c.runId(), "without checkpoints, a new run starts")
+	assert.False(t, c.resumed())
+
+	now := time.Now().UTC()
+	progress := func() map[string]*models.SourceProgress {
+		return map[string]*models.SourceProgress{"itch": {PagesTotal: 4, CompletedPages: []int64{3, 1}}}
+	}
+	require.NoError(t, storage.PutCheckpoint(ctx, models.CrawlCheckpoint{RunId: "run-1", UpdatedAt: now, Sources: progress()}))
+	removed := progress()
+	removed["oga"] = &models.SourceProgress{PagesTotal: 1}
+	require.NoError(t, storage.PutCheckpoint(ctx, models.CrawlCheckpoint{RunId: "run-2", UpdatedAt: now, Sources: removed}))
+	require.NoError(t, storage.PutCheckpoint(ctx, models.CrawlCheckpoint{RunId: "run-3", UpdatedAt: now}))
+	require.NoError(t, storage.PutCheckpoint(ctx, models.CrawlCheckpoint{RunId: "run-4", UpdatedAt: now.Add(-checkpointMaxAge - time.Hour), Sources: progress()}))
+
+	// the newest ones are stale, outdated and of a removed source
+	c = resumeOrStartCheckpoint(ctx, "run-new", sourceNames)
+	assert.Equal(t, "run-1", c.runId())
+	assert.True(t, c.resumed())
+	assert.Equal(t, []int64{2, 4}, c.remainingPages("itch"))
+	assert.Empty(t, c.remainingPages("facet:free"), "sources without a page count have no pages left")
+	runIds, err := storage.ListCheckpoints(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"run-1"}, runIds)
+}
+
+func TestCheckpointerFinish(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	c := newCheckpointer(models.CrawlCheckpoint{RunId: "run-1", Sources: make(map[string]*models.SourceProgress)})
+	c.setPagesTotal("itch", 2)
+	c.pageFetched("itch", 1, nil)
+
+	// a shutdown keeps the progress for the next trigger
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errors.New("shutting down"))
+	c.finish(ctx)
+	checkpoint, err := storage.GetCheckpoint(context.Background(), "run-1")
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1}, checkpoint.Sources["itch"].CompletedPages)
+
+	// an admin cancel throws it away
+	ctx, cancel = context.WithCancelCause(context.Background())
+	cancel(errCancelledByAdmin)
+	c.finish(ctx)
+	_, err = storage.GetCheckpoint(context.Background(), "run-1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestCheckpointerResumesWrittenAssets(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+	c := newCheckpointer(models.CrawlCheckpoint{RunId: "run-1", UpdatedAt: time.Now().UTC(), Sources: make(map[string]*models.SourceProgress)})
+	c.setPagesTotal("itch", 3)
+
+	writer, err := newSnapshotWriter(ctx, "run-1")
+	require.NoError(t, err)
+	defer writer.discard()
+	p := newPipeline(ctx, writer, fetcher.NewReportRecorder(0))
+	p.checkpoint = c
+	p.start()
+	require.NoError(t, p.addPage("itch", 1, []models.Asset{{GameId: "1"}, {GameId: "2"}}))
+	require.NoError(t, p.addPage("itch", 2, []models.Asset{{GameId: "2"}}))
+	require.NoError(t, p.finish())
+	c.pageFetched("itch", 3, []string{"3"}) // still in the pipeline
+	c.save(ctx)
+
+	checkpoint, err := storage.GetCheckpoint(ctx, "run-1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int64{1, 2}, checkpoint.Sources["itch"].CompletedPages, "only pages whose assets were all written are completed")
+	assert.Equal(t, 1, checkpoint.AssetParts)
+
+	// the next attempt writes the stored assets instead of fetching their pages
+	c = resumeOrStartCheckpoint(ctx, "run-2", []string{"itch"})
+	assert.Equal(t, []int64{3}, c.remainingPages("itch"))
+	writer, err = newSnapshotWriter(ctx, "run-1")
+	require.NoError(t, err)
+	defer writer.discard()
+	p = newPipeline(ctx, writer, fetcher.NewReportRecorder(0))
+	p.facets = facetsById(map[string][]string{"free": {"2"}})
+	p.checkpoint = c
+	p.start()
+	require.NoError(t, c.eachAsset(ctx, func(asset models.Asset) error {
+		return p.addProcessed(asset)
+	}))
+	require.NoError(t, p.finish())
+	require.NoError(t, writer.publish(ctx, models.CrawlReport{}))
+	stored, err := storage.GetAssets(ctx, "run-1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []models.Asset{{GameId: "1"}, {GameId: "2", Facets: []string{"free"}}}, stored)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	cancel(errCancelledByAdmin)
+	c.finish(ctx)
+	runIds, err := storage.ListCheckpoints(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, runIds)
+}
+
+func TestThrowawayCheckpointer(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+	require.NoError(t, storage.PutCheckpoint(ctx, models.CrawlCheckpoint{RunId: "run-1", UpdatedAt: time.Now().UTC()}))
+
+	c := newThrowawayCheckpointer("run-2")
+	assert.False(t, c.resumed())
+	c.setPagesTotal("itch", 2)
+	c.pageFetched("itch", 1, []string{"1"})
+	c.written(models.Asset{GameId: "1"})
+	c.finish(ctx)
+	c.discard(ctx)
+
+	runIds, err := storage.ListCheckpoints(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"run-1"}, runIds, "the checkpoints of other runs are left alone")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// commands are the subcommands of the binary, which runs the server if it
+// is started without one. Each returns the exit code of the process.
+var commands = map[string]func(args []string) int{
+	"crawl":     runCrawlCommand,
+	"snapshots": runSnapshotsCommand,
+	"rollback":  runRollbackCommand,
+}
+
+// triggerCLI marks runs started by the crawl command.
+const triggerCLI = "cli"
+
+// Exit codes of the crawl command.
+const (
+	exitSucceeded = 0
+	exitFailed    = 1 // the run failed or was interrupted, nothing was published
+	exitUsage     = 2
+)
+
+// pageRange limits the listing pages crawled of every source, for partial
+// crawls from the command line. The zero value includes every page.
+type pageRange struct {
+	first, last int64 // last is zero for no upper bound
+}
+
+// crawlPages is the page range of full crawls, set by the --pages flag.
+var crawlPages pageRange
+
+// parsePageRange parses "first-last", "first-" or a single page number.
+func parsePageRange(s string) (pageRange, error) {
+	firstStr, lastStr, isRange := strings.Cut(s, "-")
+	first, err := strconv.ParseInt(firstStr, 10, 64)
+	if err != nil || first < 1 {
+		return pageRange{}, fmt.Errorf("invalid first page %q", firstStr)
+	}
+	if !isRange {
+		return pageRange{first: first, last: first}, nil
+	}
+	if lastStr == "" {
+		return pageRange{first: first}, nil
+	}
+	last, err := strconv.ParseInt(lastStr, 10, 64)
+	if err != nil || last < first {
+		return pageRange{}, fmt.Errorf("invalid last page %q", lastStr)
+	}
+	return pageRange{first: first, last: last}, nil
+}
+
+func (r pageRange) contains(pageNum int64) bool {
+	return pageNum >= r.first && (r.last == 0 || pageNum <= r.last)
+}
+
+// filter returns the pages of pageNums that are in the range.
+func (r pageRange) filter(pageNums []int64) []int64 {
+	var filtered []int64
+	for _, pageNum := range pageNums {
+		if r.contains(pageNum) {
+			filtered = append(filtered, pageNum)
+		}
+	}
+	return filtered
+}
+
+// count returns how many of the pages 1..nPages are in the range.
+func (r pageRange) count(nPages int64) int64 {
+	last := nPages
+	if r.last != 0 && r.last < last {
+		last = r.last
+	}
+	return max(last-max(r.first, 1)+1, 0)
+}
+
+// runCrawlCommand runs a single crawl in the foreground and publishes its
+// snapshot, for local work and batch jobs such as a Cloud Run Job. It is
+// configured from the environment like the server, with args overriding some
+// of the settings, and returns the exit code of the process.
+func runCrawlCommand(args []string) int {
+	flags := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: dataservice crawl [flags]")
+		flags.PrintDefaults()
+	}
+	out := flags.String("out", "", "write the snapshot to this directory instead of the configured storage")
+	sourceNames := flags.String("source", "", "comma separated sources to crawl, instead of SOURCES")
+	pages := flags.String("pages", "", `listing pages to crawl of every source, such as "1-50", for a partial snapshot`)
+	mode := flags.String("mode", modeFull, "crawl mode, full or incremental")
+	if code, ok := parseFlags(flags, args, 0); !ok {
+		return code
+	}
+	if *mode != modeFull && *mode != modeIncremental {
+		fmt.Fprintf(flags.Output(), "Unknown crawl mode %q\n", *mode)
+		return exitUsage
+	}
+	if *pages != "" {
+		if *mode != modeFull {
+			fmt.Fprintln(flags.Output(), "--pages only applies to full crawls")
+			return exitUsage
+		}
+		r, err := parsePageRange(*pages)
+		if err != nil {
+			fmt.Fprintf(flags.Output(), "Invalid --pages: %v\n", err)
+			return exitUsage
+		}
+		crawlPages = r
+	}
+
+	configureFromEnv()
+	if *out != "" {
+		storage.UseDir(*out)
+	}
+	if *sourceNames != "" {
+		var err error
+		sources, err = newSources(itch, strings.Split(*sourceNames, ","))
+		if err != nil {
+			fmt.Fprintf(flags.Output(), "Invalid --source: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	// an interrupt stops the crawl, which keeps its checkpoint so that the
+	// next invocation resumes it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runs = newRunManager(ctx, fetchAndStoreAssets, crawlTimeout)
+	started, err := runs.start(*mode, triggerCLI)
+	if err != nil {
+		logging.Error("Failed to start the crawl: %v", err)
+		return exitFailed
+	}
+	runs.running.Wait()
+
+	run, err := runs.get(started.Id)
+	if err != nil {
+		logging.Error("Failed to get the outcome of run %s: %v", started.Id, err)
+		return exitFailed
+	}
+	logging.Info("Run %s %s after %d/%d pages with %d assets", run.Id, run.State,
+		run.Progress.PagesSucceeded, run.Progress.PagesTotal, run.Progress.AssetCount)
+	if run.State != models.RunSucceeded {
+		return exitFailed
+	}
+	return exitSucceeded
+}
+
+// runSnapshotsCommand lists the stored snapshots, the newest first.
+func runSnapshotsCommand(args []string) int {
+	flags := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: dataservice snapshots [flags]")
+		flags.PrintDefaults()
+	}
+	dir := flags.String("dir", "", "read the snapshots from this directory instead of the configured storage")
+	if code, ok := parseFlags(flags, args, 0); !ok {
+		return code
+	}
+	configureStorage(*dir)
+
+	snapshots, err := listSnapshots(context.Background())
+	if err != nil {
+		logging.Error("Failed to list snapshots: %v", err)
+		return exitFailed
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCURRENT\tMODE\tFINISHED\tASSETS")
+	for _, snapshot := range snapshots {
+		current := ""
+		if snapshot.Current {
+			current = "*"
+		}
+		if !snapshot.Complete {
+			fmt.Fprintf(w, "%s\t%s\tincomplete\t\t\n", snapshot.Id, current)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", snapshot.Id, current, snapshot.Mode,
+			snapshot.FinishedAt.Format(time.RFC3339), snapshot.AssetCount)
+	}
+	w.Flush()
+	return exitSucceeded
+}
+
+// runRollbackCommand points the manifest at the snapshot named in args.
+func runRollbackCommand(args []string) int {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: dataservice rollback [flags] <snapshot-id>")
+		flags.PrintDefaults()
+	}
+	dir := flags.String("dir", "", "roll back the snapshots in this directory instead of the configured storage")
+	if code, ok := parseFlags(flags, args, 1); !ok {
+		return code
+	}
+	configureStorage(*dir)
+
+	if _, err := rollbackSnapshot(context.Background(), flags.Arg(0)); err != nil {
+		logging.Error("Failed to roll back to snapshot %s: %v", flags.Arg(0), err)
+		return exitFailed
+	}
+	return exitSucceeded
+}
+
+// parseFlags parses the args of a command that takes nArgs positional
+// arguments. If the command must not run, it returns false with the exit
+// code.
+func parseFlags(flags *flag.FlagSet, args []string, nArgs int) (int, bool) {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitSucceeded, false
+		}
+		return exitUsage, false
+	}
+	if flags.NArg() != nArgs {
+		fmt.Fprintf(flags.Output(), "Expected %d arguments, got %v\n", nArgs, flags.Args())
+		flags.Usage()
+		return exitUsage, false
+	}
+	return exitSucceeded, true
+}
+
+// configureStorage sets up the storage from the environment, or uses dir if
+// it is set.
+func configureStorage(dir string) {
+	configureStorageFromEnv()
+	if dir != "" {
+		storage.UseDir(dir)
+	}
+}
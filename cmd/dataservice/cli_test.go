@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePageRange(t *testing.T) {
+	r, err := parsePageRange("3-5")
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3, 4, 5}, r.filter([]int64{1, 2, 3, 4, 5, 6}))
+	assert.Equal(t, int64(3), r.count(10))
+	assert.Equal(t, int64(2), r.count(4), "clamped to the pages of the source")
+	assert.Equal(t, int64(0), r.count(2))
+
+	r, err = parsePageRange("7")
+	require.NoError(t, err)
+	assert.Equal(t, pageRange{first: 7, last: 7}, r)
+
+	r, err = parsePageRange("99-")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), r.count(100))
+
+	// the zero value includes every page
+	assert.Equal(t, int64(10), pageRange{}.count(10))
+	assert.Equal(t, []int64{1, 2}, pageRange{}.filter([]int64{1, 2}))
+
+	for _, invalid := range []string{"", "0", "a-5", "5-3", "1-b"} {
+		_, err := parsePageRange(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
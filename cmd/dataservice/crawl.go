@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/logging"
+	"itchgrep/pkg/models"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Crawl modes, as passed to /trigger-fetch?mode=...
+const (
+	modeFull        = "full"
+	modeIncremental = "incremental"
+)
+
+// errDriftCheckFailed is returned for runs that are not published because
+// they failed the parser drift check, see passesDriftCheck.
+var errDriftCheckFailed = errors.New("parser drift check failed, the markup has probably changed")
+
+// fetchAndStoreAssets runs a crawl in the given mode and publishes its result.
+// The outcome of every page is recorded in recorder, which the run manager
+// reads the progress from. It returns why nothing was published, if so.
+func fetchAndStoreAssets(ctx context.Context, runId string, mode string, recorder *fetcher.ReportRecorder) error {
+	recorder.SetRunId(runId)
+
+	writer, err := newSnapshotWriter(ctx, runId)
+	if err != nil {
+		return fmt.Errorf("failed to start snapshot: %w", err)
+	}
+	defer writer.discard()
+
+	if mode == modeIncremental {
+		if base, ok := loadIncrementalBase(ctx); ok {
+			if err := crawlNewAssets(ctx, recorder, base, writer); err != nil {
+				return err
+			}
+			report := recorder.Finish(writer.count)
+			logging.Info("Successfully fetched %d assets in %s mode, %d/%d pages failed %v",
+				writer.count, report.Mode, report.PagesFailed, report.PagesTotal, report.FailuresByKind)
+			if !passesDriftCheck(report) {
+				return errDriftCheckFailed
+			}
+			if err := checkGuardrails(ctx, int64(writer.count), writer.fill.Rates()); err != nil {
+				logging.Error("Not publishing run %s: %v", runId, err)
+				return err
+			}
+			if err := writer.publish(ctx, report); err != nil {
+				return fmt.Errorf("failed to publish: %w", err)
+			}
+			return nil
+		}
+	}
+
+	// FETCHING ASSETS
+	var checkpoint *checkpointer
+	if crawlPages != (pageRange{}) {
+		// a partial crawl must neither write the stored assets of a full one
+		// nor throw away its progress
+		checkpoint = newThrowawayCheckpointer(runId)
+	} else {
+		var sourceNames []string
+		for _, source := range crawledSources() {
+			sourceNames = append(sourceNames, source.Name())
+		}
+		checkpoint = resumeOrStartCheckpoint(ctx, runId, sourceNames)
+	}
+	if resumedFrom := checkpoint.runId(); resumedFrom != runId {
+		recorder.SetResumedFrom(resumedFrom)
+	}
+	checkpoint.start()
+	err = crawlAllAssets(ctx, recorder, checkpoint, writer)
+	checkpoint.finish(ctx)
+	if err != nil {
+		return err
+	}
+
+	report := recorder.Finish(writer.count)
+	logging.Info("Successfully fetched %d assets in %s mode, %d/%d pages failed %v",
+		writer.count, report.Mode, report.PagesFailed, report.PagesTotal, report.FailuresByKind)
+
+	if !passesDriftCheck(report) {
+		// resuming would only publish the same broken pages again
+		checkpoint.discard(ctx)
+		return errDriftCheckFailed
+	}
+	if err := checkGuardrails(ctx, int64(writer.count), writer.fill.Rates()); err != nil {
+		// the checkpoint stays around, so the next trigger retries the
+		// pages that failed
+		logging.Error("Not publishing run %s: %v", runId, err)
+		return err
+	}
+	if err := writer.publish(ctx, report); err != nil {
+		// the checkpoint stays around, so the next trigger does not have
+		// to crawl everything again
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	checkpoint.discard(ctx)
+	return nil
+}
+
+// Drift check modes, taken from DRIFT_CHECK.
+const (
+	driftCheckFail = "fail" // refuse to publish a run that failed the drift check
+	driftCheckWarn = "warn" // only log drift failures
+)
+
+var driftCheck = driftCheckFail
+
+// passesDriftCheck logs the parser drift findings of report and reports
+// whether the run may be published.
+func passesDriftCheck(report models.CrawlReport) bool {
+	if len(report.EmptyPages) > 0 || len(report.LowFillPages) > 0 {
+		logging.Warning("Run %s has %d empty and %d low fill pages, fill rates %+v",
+			report.RunId, len(report.EmptyPages), len(report.LowFillPages), report.FillRates)
+	}
+	for _, warning := range report.DriftWarnings {
+		logging.Warning("Run %s parser drift: %s", report.RunId, warning)
+	}
+	if len(report.DriftFailures) == 0 {
+		return true
+	}
+	for _, failure := range report.DriftFailures {
+		logging.Error("Run %s parser drift: %s", report.RunId, failure)
+	}
+	if driftCheck == driftCheckWarn {
+		logging.Warning("Publishing run %s despite parser drift, DRIFT_CHECK is %q", report.RunId, driftCheck)
+		return true
+	}
+	logging.Error("Not publishing run %s, the itch.io markup has probably changed", report.RunId)
+	return false
+}
+
+// crawledSources returns everything a full crawl walks: the facet listings,
+// then the sources.
+func crawledSources() []fetcher.Source {
+	return append(facetSources(), sources...)
+}
+
+// crawlAllAssets crawls every page of every source and facet listing in
+// crawlPages, skipping those the checkpoint already has, and streams the
+// assets into writer. The facet listings are crawled first, so that the
+// facets of every asset are known when it is written. It returns an error if
+// the crawl was cancelled or a source could not be crawled at all, in which
+// case the snapshot must be discarded.
+func crawlAllAssets(ctx context.Context, recorder *fetcher.ReportRecorder, checkpoint *checkpointer, writer *snapshotWriter) error {
+	recorder.SetMode(modeFull, time.Now().UTC())
+
+	crawled := crawledSources()
+	pageNums := make(map[string][]int64, len(crawled))
+	var pagesTotal, pagesResumed int64
+	for _, source := range crawled {
+		recorder.SetDriftThresholds(source.Name(), fetcher.DriftThresholdsOf(source))
+
+		// a resumed run keeps the page count of its first attempt, so that
+		// the completed pages still line up
+		if checkpoint.pagesTotal(source.Name()) == 0 {
+			nPages, err := source.PageCount(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return fmt.Errorf("crawl stopped before it started: %w", context.Cause(ctx))
+				}
+				// publishing a snapshot without this source would
+				// look like all of its assets were deleted
+				return fmt.Errorf("failed to get the page count of source %s (%s): %w",
+					source.Name(), fetcher.ErrorKind(err), err)
+			}
+			checkpoint.setPagesTotal(source.Name(), nPages)
+		}
+
+		// pages outside of crawlPages count as neither crawled nor total
+		nPages := crawlPages.count(checkpoint.pagesTotal(source.Name()))
+		pageNums[source.Name()] = crawlPages.filter(checkpoint.remainingPages(source.Name()))
+		pagesTotal += nPages
+		pagesResumed += nPages - int64(len(pageNums[source.Name()]))
+	}
+	recorder.SetPagesTotal(pagesTotal)
+	recorder.SetPagesResumed(pagesResumed)
+
+	for _, source := range facetSources() {
+		logging.Info("Crawling %d pages of facet listing %s", len(pageNums[source.Name()]), source.Name())
+		crawlSourcePages(ctx, source, pageNums[source.Name()], recorder, checkpoint, nil)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("crawl cancelled while crawling facet listings: %w", context.Cause(ctx))
+	}
+
+	p := newPipeline(ctx, writer, recorder)
+	p.facets = facetsById(checkpoint.facetMembers())
+	p.fetchDetails = crawlDetails
+	p.checkpoint = checkpoint
+	p.start()
+
+	// the pages a resumed run already has are not fetched again, but the
+	// assets it wrote still have to be written to this snapshot
+	resumed := 0
+	addErr := checkpoint.eachAsset(p.ctx, func(asset models.Asset) error {
+		resumed++
+		return p.addProcessed(asset)
+	})
+	if resumed > 0 {
+		logging.Info("Handed %d assets of the resumed run to the writer", resumed)
+	}
+	for _, source := range sources {
+		if addErr != nil {
+			break
+		}
+		logging.Info("Crawling %d pages of source %s", len(pageNums[source.Name()]), source.Name())
+		addErr = crawlSourcePages(p.ctx, source, pageNums[source.Name()], recorder, checkpoint, p)
+	}
+	if err := p.finish(); err != nil {
+		return fmt.Errorf("crawl cancelled after writing %d assets: %w", writer.count, err)
+	}
+	if addErr != nil {
+		return fmt.Errorf("failed to write the crawled assets: %w", addErr)
+	}
+	return nil
+}
+
+// crawlSourcePages fetches the given pages of a source on the crawl workers
+// and hands the assets found on them to p, in no particular order, which
+// records them in its checkpoint. The pages of facet listings are only
+// recorded in checkpoint, which may be nil, and p is nil for them. It returns
+// the first error of handing assets to p, after which no more pages are
+// fetched.
+func crawlSourcePages(ctx context.Context, source fetcher.Source, pageNums []int64, recorder *fetcher.ReportRecorder, checkpoint *checkpointer, p *pipeline) error {
+	var addErr error
+	var addErrOnce sync.Once
+	var pagesFetched atomic.Int64
+	var pagesInProgress atomic.Int64
+
+	// every 5 seconds, print the progress
+	quitProgressLog := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-quitProgressLog:
+				return
+			case <-time.After(5 * time.Second):
+				logging.Info("Pages fetched: %d/%d, in progress: %d, rate: %.2f req/s",
+					pagesFetched.Load(), len(pageNums), pagesInProgress.Load(), itch.Limit())
+			}
+		}
+	}()
+
+	fetcher.ForEach(ctx, crawlWorkers, pageNums, func(ctx context.Context, pageNum int64) {
+		defer pagesFetched.Add(1)
+		defer pagesInProgress.Add(-1)
+		pagesInProgress.Add(1)
+		pageAssets, err := fetchSourcePage(ctx, source, pageNum, recorder)
+		if err != nil {
+			return
+		}
+		if facet, ok := source.(facetSource); ok {
+			// facet listings only tell which assets belong to them
+			checkpoint.facetPageDone(facet, pageNum, pageAssets)
+			return
+		}
+		if err := p.addPage(source.Name(), pageNum, pageAssets); err != nil {
+			// the pipeline is cancelled, which stops the other workers too
+			addErrOnce.Do(func() { addErr = err })
+		}
+	})
+	quitProgressLog <- true
+	return addErr
+}
+
+// fetchSourcePage fetches and parses a single page of a source, recording
+// the outcome in the report.
+func fetchSourcePage(ctx context.Context, source fetcher.Source, pageNum int64, recorder *fetcher.ReportRecorder) ([]models.Asset, error) {
+	start := time.Now()
+	pageAssets, err := source.FetchPage(ctx, pageNum)
+	if err != nil {
+		logging.Error("Failed to fetch page %d of source %s: %v", pageNum, source.Name(), err)
+		recorder.PageFailed(source.Name(), pageNum, err, time.Since(start))
+		return nil, err
+	}
+	if warnings := recorder.PageSucceeded(source.Name(), pageNum, pageAssets, time.Since(start)); len(warnings) > 0 {
+		logging.Warning("Page %d of source %s looks off, has the markup changed? %v", pageNum, source.Name(), warnings)
+	}
+	return pageAssets, nil
+}
+
+// fetchAssetDetails visits the page of every asset and fills in the details
+// found there, for the few assets an incremental crawl finds; a full crawl
+// does this in its pipeline. The shared rate limiter of the fetcher keeps
+// this stage as polite as the listing crawl. Assets whose page can not be
+// fetched are kept with their listing data only. Assets of sources without
+// detail pages are skipped.
+func fetchAssetDetails(ctx context.Context, assets []models.Asset, recorder *fetcher.ReportRecorder) {
+	detailSources := make(map[string]fetcher.DetailSource)
+	for _, source := range sources {
+		if detailSource, ok := source.(fetcher.DetailSource); ok {
+			detailSources[source.Name()] = detailSource
+		}
+	}
+
+	var indices []int
+	for i, asset := range assets {
+		if detailSources[fetcher.SourceOf(asset)] != nil {
+			indices = append(indices, i)
+		}
+	}
+	logging.Info("Fetching details of %d assets, %d skipped...", len(indices), len(assets)-len(indices))
+
+	var detailsFetched atomic.Int64
+	quitProgressLog := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-quitProgressLog:
+				return
+			case <-time.After(5 * time.Second):
+				logging.Info("Asset details fetched: %d/%d, rate: %.2f req/s",
+					detailsFetched.Load(), len(indices), itch.Limit())
+			}
+		}
+	}()
+
+	// every worker writes to a distinct element, so no locking is needed
+	fetcher.ForEach(ctx, crawlWorkers, indices, func(ctx context.Context, i int) {
+		defer detailsFetched.Add(1)
+		details, err := detailSources[fetcher.SourceOf(assets[i])].FetchDetails(ctx, assets[i])
+		if err != nil {
+			if ctx.Err() == nil {
+				logging.Warning("Failed to fetch details of asset %s: %v", assets[i].GameId, err)
+				recorder.DetailFailed(err)
+			}
+			return
+		}
+		details.Apply(&assets[i])
+		recorder.DetailSucceeded()
+	})
+	quitProgressLog <- true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"itchgrep/internal/fetcher"
+	"slices"
+)
+
+// facetListings are the itch.io listings below ITCH_BASE_URL, such as "free"
+// or "tag-pixel-art", that a full crawl walks to find out which assets belong
+// to them. Taken from CRAWL_FACETS as a comma separated list.
+var facetListings []string
+
+// facetSource is a facet listing of itch.io. Its pages are recorded under a
+// name of their own, so that they do not mix with those of the main listing
+// in reports and checkpoints.
+type facetSource struct {
+	*fetcher.ItchSource
+	facet string
+}
+
+func newFacetSource(f *fetcher.Fetcher, facet string) facetSource {
+	return facetSource{ItchSource: fetcher.NewItchSource(f, facet), facet: facet}
+}
+
+func (s facetSource) Name() string {
+	return "facet:" + s.facet
+}
+
+// facetSources returns a source for every configured facet listing.
+func facetSources() []fetcher.Source {
+	var sources []fetcher.Source
+	for _, facet := range facetListings {
+		sources = append(sources, newFacetSource(itch, facet))
+	}
+	return sources
+}
+
+// facetsById returns the sorted facets of every GameId in members, which
+// lists the GameIds found under each facet.
+func facetsById(members map[string][]string) map[string][]string {
+	facets := make(map[string][]string)
+	for facet, gameIds := range members {
+		for _, gameId := range gameIds {
+			facets[gameId] = append(facets[gameId], facet)
+		}
+	}
+	for gameId := range facets {
+		slices.Sort(facets[gameId])
+		facets[gameId] = slices.Compact(facets[gameId])
+	}
+	return facets
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"strconv"
+	"strings"
+)
+
+// The publish guardrails, which every snapshot must pass before it is
+// published. Taken from PUBLISH_MIN_ASSETS, PUBLISH_MAX_DROP and
+// PUBLISH_MIN_FILL_RATES.
+var (
+	// publishMinAssets is the smallest number of assets a snapshot must have.
+	publishMinAssets int64 = 1
+
+	// publishMaxDrop is how many percent fewer assets a snapshot may have
+	// than the current one. A crawl that was throttled heavily looks like a
+	// large part of the catalogue disappeared.
+	publishMaxDrop = 20.0
+
+	// publishMinFillRates are the smallest shares of the assets of a
+	// snapshot that must have each field. Zero rates are not checked.
+	publishMinFillRates = models.FillRates{GameId: 0.99, Title: 0.95, Link: 0.99}
+)
+
+// guardrailError lists why a snapshot failed the publish guardrails.
+type guardrailError struct {
+	reasons []string
+}
+
+func (e *guardrailError) Error() string {
+	return "snapshot failed the publish guardrails: " + strings.Join(e.reasons, "; ")
+}
+
+// checkGuardrails checks the number of assets of a snapshot and their fill
+// rates against the publish guardrails and the current snapshot. It returns
+// a *guardrailError if the snapshot must not be published.
+func checkGuardrails(ctx context.Context, count int64, rates models.FillRates) error {
+	var reasons []string
+	if count < publishMinAssets {
+		reasons = append(reasons, fmt.Sprintf("%d assets are fewer than the minimum of %d", count, publishMinAssets))
+	}
+
+	manifest, err := storage.GetManifest(ctx)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		// the first snapshot has nothing to compare to
+	case err != nil:
+		return fmt.Errorf("failed to get the current snapshot to compare to: %w", err)
+	case manifest.AssetCount > 0:
+		previous := float64(manifest.AssetCount)
+		if drop := (previous - float64(count)) / previous * 100; drop > publishMaxDrop {
+			reasons = append(reasons, fmt.Sprintf("%d assets are %.1f%% fewer than the %d of snapshot %s, at most %.1f%% are allowed",
+				count, drop, manifest.AssetCount, manifest.SnapshotId, publishMaxDrop))
+		}
+	}
+
+	for _, field := range fillRateFields {
+		rate, minRate := field.rate(rates), field.rate(publishMinFillRates)
+		if count > 0 && rate < minRate {
+			reasons = append(reasons, fmt.Sprintf("%s fill rate %.3f is below the minimum of %.3f", field.name, rate, minRate))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return &guardrailError{reasons: reasons}
+	}
+	return nil
+}
+
+// fillRateFields are the fields of models.FillRates that can be given a
+// minimum, by their name in PUBLISH_MIN_FILL_RATES.
+var fillRateFields = []struct {
+	name string
+	rate func(models.FillRates) float64
+	set  func(*models.FillRates, float64)
+}{
+	{"GameId", func(r models.FillRates) float64 { return r.GameId }, func(r *models.FillRates, v float64) { r.GameId = v }},
+	{"Title", func(r models.FillRates) float64 { return r.Title }, func(r *models.FillRates, v float64) { r.Title = v }},
+	{"Author", func(r models.FillRates) float64 { return r.Author }, func(r *models.FillRates, v float64) { r.Author = v }},
+	{"Description", func(r models.FillRates) float64 { return r.Description }, func(r *models.FillRates, v float64) { r.Description = v }},
+	{"Link", func(r models.FillRates) float64 { return r.Link }, func(r *models.FillRates, v float64) { r.Link = v }},
+	{"ThumbUrl", func(r models.FillRates) float64 { return r.ThumbUrl }, func(r *models.FillRates, v float64) { r.ThumbUrl = v }},
+}
+
+// parseFillRates parses a comma separated list of minimum fill rates such
+// as "Title=0.95,Link=0.99". Fields that are not listed are not checked.
+func parseFillRates(s string) (models.FillRates, error) {
+	var rates models.FillRates
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return rates, fmt.Errorf("expected field=rate, got %q", entry)
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return rates, fmt.Errorf("invalid rate %q of %s, must be between 0 and 1", value, name)
+		}
+		found := false
+		for _, field := range fillRateFields {
+			if strings.EqualFold(field.name, name) {
+				field.set(&rates, rate)
+				found = true
+			}
+		}
+		if !found {
+			return rates, fmt.Errorf("unknown field %q", name)
+		}
+	}
+	return rates, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckGuardrails(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+	check := func(assets []models.Asset) error {
+		return checkGuardrails(ctx, int64(len(assets)), fetcher.ComputeFillRates(assets))
+	}
+	assets := func(n int) []models.Asset {
+		assets := make([]models.Asset, n)
+		for i := range assets {
+			assets[i] = models.Asset{GameId: fmt.Sprint(i), Title: "Asset", Link: "https://example.com"}
+		}
+		return assets
+	}
+
+	// without a current snapshot, only the asset count and fill rates count
+	assert.NoError(t, check(assets(10)))
+	var guardrailErr *guardrailError
+	require.ErrorAs(t, check(nil), &guardrailErr)
+	assert.Len(t, guardrailErr.reasons, 1)
+
+	require.NoError(t, storage.PutManifest(ctx, models.Manifest{SnapshotId: "run-1", AssetCount: 100}))
+	assert.NoError(t, check(assets(80)), "a drop of 20% is allowed")
+	err := check(assets(79))
+	require.ErrorAs(t, err, &guardrailErr)
+	assert.Contains(t, err.Error(), "21.0% fewer than the 100 of snapshot run-1")
+
+	// crawls of some pages only are checked too, unless the drop is allowed
+	previousPages, previousMaxDrop := crawlPages, publishMaxDrop
+	defer func() { crawlPages, publishMaxDrop = previousPages, previousMaxDrop }()
+	crawlPages = pageRange{first: 1, last: 2}
+	assert.ErrorAs(t, check(assets(10)), &guardrailErr)
+	publishMaxDrop = 100
+	assert.NoError(t, check(assets(10)))
+	crawlPages, publishMaxDrop = previousPages, previousMaxDrop
+
+	broken := assets(100)
+	for i := range broken[:10] {
+		broken[i].Title = ""
+	}
+	err = check(broken)
+	require.ErrorAs(t, err, &guardrailErr)
+	assert.Equal(t, []string{"Title fill rate 0.900 is below the minimum of 0.950"}, guardrailErr.reasons)
+}
+
+func TestParseFillRates(t *testing.T) {
+	rates, err := parseFillRates("Title=0.95, link=1")
+	require.NoError(t, err)
+	assert.Equal(t, models.FillRates{Title: 0.95, Link: 1}, rates)
+
+	rates, err = parseFillRates("")
+	require.NoError(t, err)
+	assert.Equal(t, models.FillRates{}, rates, "an empty list disables the check")
+
+	for _, invalid := range []string{"Title", "Title=2", "Title=x", "Assets=0.5"} {
+		_, err := parseFillRates(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"strconv"
+	"time"
+)
+
+// incrementalListings are walked by an incremental crawl, newest first. Taken
+// from INCREMENTAL_LISTINGS as a comma separated list.
+var incrementalListings = []string{"newest"}
+
+// incrementalMaxPages bounds how deep an incremental crawl walks into each
+// listing, in case it never reaches a page of already known assets.
+const incrementalMaxPages = 50
+
+// fullCrawlInterval is how old the last full crawl may get before an
+// incremental trigger runs a full crawl instead, so that deleted assets
+// eventually disappear. Taken from FULL_CRAWL_INTERVAL.
+var fullCrawlInterval = 7 * 24 * time.Hour
+
+// incrementalBase is the snapshot an incremental crawl builds on.
+type incrementalBase struct {
+	snapshotId      string
+	known           map[string]uint64 // the listing fingerprint of each of its assets
+	lastFullCrawlAt time.Time
+}
+
+// loadIncrementalBase reads the snapshot an incremental crawl builds on. It
+// returns false if there is none, or if its full crawl is too old, in which
+// case a full crawl has to run instead.
+func loadIncrementalBase(ctx context.Context) (incrementalBase, bool) {
+	manifest, err := storage.GetManifest(ctx)
+	if err != nil {
+		logging.Warning("No previous snapshot to build on, running a full crawl instead: %v", err)
+		return incrementalBase{}, false
+	}
+	previousReport, err := storage.GetCrawlReport(ctx, manifest.SnapshotId)
+	if err != nil || previousReport.LastFullCrawlAt.IsZero() {
+		logging.Warning("No previous crawl report, running a full crawl instead: %v", err)
+		return incrementalBase{}, false
+	}
+	if time.Since(previousReport.LastFullCrawlAt) > fullCrawlInterval {
+		logging.Info("Last full crawl ran at %v, running a full crawl instead", previousReport.LastFullCrawlAt)
+		return incrementalBase{}, false
+	}
+	known := make(map[string]uint64)
+	err = storage.EachAsset(ctx, manifest.SnapshotId, func(asset models.Asset) error {
+		known[asset.GameId] = listingFingerprint(asset)
+		return nil
+	})
+	if err != nil || len(known) == 0 {
+		logging.Warning("No previous assets to build on, running a full crawl instead: %v", err)
+		return incrementalBase{}, false
+	}
+	return incrementalBase{snapshotId: manifest.SnapshotId, known: known, lastFullCrawlAt: previousReport.LastFullCrawlAt}, true
+}
+
+// listingFingerprint hashes the fields of asset that its listing cell shows,
+// to tell whether an already known asset changed since.
+func listingFingerprint(asset models.Asset) uint64 {
+	h := fnv.New64a()
+	for _, field := range []string{
+		asset.Title, asset.Author, asset.Description, asset.Link, asset.ThumbUrl,
+		strconv.FormatBool(asset.Free), strconv.FormatInt(asset.PriceCents, 10),
+		asset.Currency, strconv.FormatInt(asset.DiscountPercent, 10),
+	} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// crawlNewAssets walks the newest-first listings until it reaches a page that
+// only contains assets we already know, unchanged, and streams what it found merged into
+// the assets of base into writer. Only itch.io has such listings, the assets
+// of every other source are carried over from base until the next full
+// crawl. It returns an error if the crawl was cancelled or has gaps.
+func crawlNewAssets(ctx context.Context, recorder *fetcher.ReportRecorder, base incrementalBase, writer *snapshotWriter) error {
+	recorder.SetMode(modeIncremental, base.lastFullCrawlAt)
+
+	var changed []models.Asset
+	seen := make(map[string]bool)
+	for _, listing := range incrementalListings {
+		source := fetcher.NewItchSource(itch, listing)
+		reachedKnown := false
+		for pageNum := int64(1); pageNum <= incrementalMaxPages; pageNum++ {
+			recorder.AddPagesTotal(1)
+			pageAssets, err := fetchSourcePage(ctx, source, pageNum, recorder)
+			if ctx.Err() != nil {
+				return fmt.Errorf("incremental crawl cancelled: %w", context.Cause(ctx))
+			}
+			if err != nil {
+				// a gap in the newest assets would go unnoticed until the
+				// next full crawl, so better not publish anything
+				return fmt.Errorf("incremental crawl of %s failed at page %d: %w", listing, pageNum, err)
+			}
+
+			// a listing of recently updated assets starts with known
+			// assets, so only unchanged ones tell that we caught up
+			fresh := 0
+			for _, asset := range pageAssets {
+				if fingerprint, ok := base.known[asset.GameId]; !ok || fingerprint != listingFingerprint(asset) {
+					fresh++
+				}
+				if !seen[asset.GameId] {
+					seen[asset.GameId] = true
+					changed = append(changed, asset)
+				}
+			}
+			logging.Info("Listing %s page %d: %d of %d assets are new or changed", listing, pageNum, fresh, len(pageAssets))
+			if fresh == 0 {
+				reachedKnown = true
+				break // we reached assets we already have
+			}
+		}
+		if !reachedKnown {
+			logging.Warning("Listing %s still had new or changed assets after %d pages, the rest is left to the next full crawl",
+				listing, incrementalMaxPages)
+		}
+	}
+
+	if crawlDetails && len(changed) > 0 {
+		fetchAssetDetails(ctx, changed, recorder)
+		if ctx.Err() != nil {
+			return fmt.Errorf("crawl cancelled while fetching asset details: %w", context.Cause(ctx))
+		}
+	}
+
+	p := newPipeline(ctx, writer, recorder)
+	p.start()
+	mergeErr := mergeAssets(p.ctx, base.snapshotId, changed, p)
+	if err := p.finish(); err != nil {
+		return fmt.Errorf("incremental crawl cancelled after writing %d assets: %w", writer.count, err)
+	}
+	if mergeErr != nil {
+		return fmt.Errorf("failed to merge into snapshot %s: %w", base.snapshotId, mergeErr)
+	}
+	return nil
+}
+
+// mergeAssets applies changed assets onto the assets of the given snapshot
+// and hands the result to p. Known assets get their listing data updated but
+// keep their popularity and facets, since the newest-first listings say
+// nothing about them. New assets are ranked behind every known one until
+// the next full crawl.
+func mergeAssets(ctx context.Context, snapshotId string, changed []models.Asset, p *pipeline) error {
+	byId := make(map[string]int, len(changed))
+	for i, asset := range changed {
+		byId[asset.GameId] = i
+	}
+
+	var leastPopular int64
+	merged, updated := 0, 0
+	err := storage.EachAsset(ctx, snapshotId, func(asset models.Asset) error {
+		if asset.InvPopularity > leastPopular {
+			leastPopular = asset.InvPopularity
+		}
+		if i, ok := byId[asset.GameId]; ok {
+			update := changed[i]
+			update.InvPopularity = asset.InvPopularity
+			update.Facets = asset.Facets
+			if !crawlDetails {
+				// keep the details of earlier crawls if this one skipped them
+				fetcher.AssetDetailsOf(asset).Apply(&update)
+			}
+			asset = update
+			delete(byId, asset.GameId)
+			updated++
+		}
+		merged++
+		return p.add(asset)
+	})
+	if err != nil {
+		return err
+	}
+
+	// what is left is new, in the order of the listings
+	added := 0
+	for _, asset := range changed {
+		if _, ok := byId[asset.GameId]; !ok {
+			continue
+		}
+		asset.InvPopularity = leastPopular + 1
+		if err := p.add(asset); err != nil {
+			return err
+		}
+		added++
+	}
+	logging.Info("Merged incremental crawl: %d new, %d updated, %d total", added, updated, merged+added)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveListing points itch at a test server that answers the pages of the
+// "newest" listing with the given assets, and counts the requested pages.
+func serveListing(t *testing.T, pages ...[]models.Asset) *int {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var pageNum int
+		fmt.Sscan(r.URL.Query().Get("page"), &pageNum)
+		var content strings.Builder
+		if pageNum >= 1 && pageNum <= len(pages) {
+			for _, asset := range pages[pageNum-1] {
+				fmt.Fprintf(&content, `<div class="game_cell" data-game_id="%s">`+
+					`<a class="thumb_link" href="%s"><img data-lazy_src="%s"></a>`+
+					`<div class="title">%s</div><div class="game_author"><a>%s</a></div></div>`,
+					asset.GameId, asset.Link, asset.ThumbUrl, asset.Title, asset.Author)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"num_items": 1, "page": pageNum, "content": content.String()})
+	}))
+	t.Cleanup(server.Close)
+
+	previous := itch
+	t.Cleanup(func() { itch = previous })
+	itch = fetcher.NewFetcher(fetcher.Config{
+		Client:  server.Client(),
+		BaseURL: server.URL + "/game-assets",
+		Retry:   fetcher.RetryPolicy{MaxAttempts: 1},
+	})
+	return &requests
+}
+
+// putSnapshot stores a published snapshot whose full crawl ran at
+// lastFullCrawlAt.
+func putSnapshot(t *testing.T, snapshotId string, lastFullCrawlAt time.Time, assets ...models.Asset) {
+	ctx := context.Background()
+	require.NoError(t, storage.PutAssets(ctx, snapshotId, assets))
+	require.NoError(t, storage.PutCrawlReport(ctx, snapshotId, models.CrawlReport{RunId: snapshotId, LastFullCrawlAt: lastFullCrawlAt}))
+	require.NoError(t, storage.PutManifest(ctx, models.Manifest{SnapshotId: snapshotId, AssetCount: len(assets)}))
+}
+
+func itchAsset(gameId, title string) models.Asset {
+	return models.Asset{
+		GameId: gameId, Source: fetcher.ItchSourceName, Title: title, Author: "author",
+		Link: "https://author.itch.io/" + gameId, ThumbUrl: "https://img.itch.zone/" + gameId + ".png",
+		Free: true,
+	}
+}
+
+func TestLoadIncrementalBase(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+
+	_, ok := loadIncrementalBase(ctx)
+	assert.False(t, ok, "without a snapshot, a full crawl runs")
+
+	putSnapshot(t, "run-1", time.Now().UTC().Add(-time.Hour), itchAsset("1", "Bones"))
+	base, ok := loadIncrementalBase(ctx)
+	require.True(t, ok)
+	assert.Equal(t, "run-1", base.snapshotId)
+	assert.Equal(t, map[string]uint64{"1": listingFingerprint(itchAsset("1", "Bones"))}, base.known)
+
+	putSnapshot(t, "run-2", time.Now().UTC().Add(-fullCrawlInterval-time.Hour), itchAsset("1", "Bones"))
+	_, ok = loadIncrementalBase(ctx)
+	assert.False(t, ok, "after FULL_CRAWL_INTERVAL, a full crawl runs")
+}
+
+func TestCrawlNewAssets(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+
+	known := itchAsset("1", "Bones")
+	known.InvPopularity = 1
+	updated := itchAsset("2", "Trees")
+	updated.InvPopularity = 2
+	updated.Facets = []string{"free"}
+	other := models.Asset{GameId: "oga:rocks", Source: "oga", Title: "Rocks", InvPopularity: 3}
+	putSnapshot(t, "run-1", time.Now().UTC(), known, updated, other)
+
+	// like a listing of recently updated assets, the first page only has
+	// a known asset, which changed
+	requests := serveListing(t,
+		[]models.Asset{itchAsset("2", "Trees 2")},
+		[]models.Asset{itchAsset("3", "Swords")},
+		[]models.Asset{known},
+		[]models.Asset{itchAsset("4", "Never reached")},
+	)
+
+	base, ok := loadIncrementalBase(ctx)
+	require.True(t, ok)
+	writer, err := newSnapshotWriter(ctx, "run-2")
+	require.NoError(t, err)
+	defer writer.discard()
+	recorder := fetcher.NewReportRecorder(0)
+	require.NoError(t, crawlNewAssets(ctx, recorder, base, writer))
+	assert.Equal(t, 3, *requests, "the walk stops at the first page of known, unchanged assets")
+	require.NoError(t, writer.publish(ctx, recorder.Finish(writer.count)))
+
+	stored, err := storage.GetAssets(ctx, "run-2")
+	require.NoError(t, err)
+	byId := make(map[string]models.Asset)
+	for _, asset := range stored {
+		byId[asset.GameId] = asset
+	}
+	require.Len(t, byId, 4)
+	assert.Equal(t, "Bones", byId["1"].Title)
+	assert.Equal(t, "Trees 2", byId["2"].Title, "changed assets are updated")
+	assert.Equal(t, int64(2), byId["2"].InvPopularity, "and keep their popularity")
+	assert.Equal(t, []string{"free"}, byId["2"].Facets, "and facets")
+	assert.Equal(t, int64(4), byId["3"].InvPopularity, "new assets rank behind every known one")
+	assert.Equal(t, "Rocks", byId["oga:rocks"].Title, "other sources are carried over")
+}
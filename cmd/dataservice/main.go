@@ -1,191 +1,453 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"itchgrep/internal/auth"
 	"itchgrep/internal/fetcher"
 	"itchgrep/internal/logging"
 	"itchgrep/internal/storage"
-	"itchgrep/pkg/models"
-	"math"
-	"math/rand"
 	"net/http"
 	"os"
-	"sync"
-	"sync/atomic"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/blevesearch/bleve"
+	"github.com/go-chi/chi/v5"
 )
 
-func main() {
-	logging.Init("", true)
+// itch is the fetcher used for all crawls, configured in main.
+var itch *fetcher.Fetcher
 
-	http.HandleFunc("/trigger-fetch", handleFetchTrigger)
-	port := fmt.Sprintf(":%s", os.Getenv("PORT")) // as per cloud run standard
-	if port == ":" {
-		port = ":8080"
+// crawlWorkers is the number of pages fetched at the same time, taken from
+// CRAWL_WORKERS.
+var crawlWorkers = 8
+
+// newFetcherFromEnv builds the fetcher for this service. ITCH_BASE_URL and
+// FETCH_USER_AGENT can be set to point the crawl at a mirror or a test
+// server instead of the live site. CRAWL_RPS limits the requests per second.
+func newFetcherFromEnv() *fetcher.Fetcher {
+	baseURL := os.Getenv("ITCH_BASE_URL")
+	if baseURL != "" {
+		logging.Info("ITCH_BASE_URL: %s", baseURL)
 	}
-	logging.Info("Server listening on port %s", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		logging.Fatal("Server failed to start: %v", err)
+
+	requestsPerSecond := 4.0
+	if rpsStr := os.Getenv("CRAWL_RPS"); rpsStr != "" {
+		rps, err := strconv.ParseFloat(rpsStr, 64)
+		if err != nil || rps <= 0 {
+			logging.Error("Invalid CRAWL_RPS, defaulting to %v: %s", requestsPerSecond, rpsStr)
+		} else {
+			requestsPerSecond = rps
+		}
+	}
+	logging.Info("CRAWL_RPS: %v", requestsPerSecond)
+
+	// FETCH_RECORD_DIR saves every response to a cassette directory,
+	// FETCH_REPLAY_DIR serves them back from one without touching the network
+	client := &http.Client{Timeout: 30 * time.Second}
+	if replayDir := os.Getenv("FETCH_REPLAY_DIR"); replayDir != "" {
+		logging.Info("FETCH_REPLAY_DIR: %s", replayDir)
+		client.Transport = &fetcher.ReplayTransport{Dir: replayDir}
+	} else if recordDir := os.Getenv("FETCH_RECORD_DIR"); recordDir != "" {
+		logging.Info("FETCH_RECORD_DIR: %s", recordDir)
+		client.Transport = &fetcher.RecordingTransport{Dir: recordDir}
 	}
+
+	return fetcher.NewFetcher(fetcher.Config{
+		Client:    client,
+		BaseURL:   baseURL,
+		UserAgent: os.Getenv("FETCH_USER_AGENT"),
+		Limiter:   fetcher.NewRateLimiter(requestsPerSecond, 1),
+	})
 }
 
-func handleFetchTrigger(w http.ResponseWriter, r *http.Request) {
-	// Ensure that we only accept GET requests
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// sources are crawled by a full crawl, in this order. Taken from SOURCES.
+var sources []fetcher.Source
+
+// newSourcesFromEnv builds the sources named in the comma separated SOURCES,
+// which defaults to itch.io alone.
+func newSourcesFromEnv(f *fetcher.Fetcher) ([]fetcher.Source, error) {
+	names := []string{fetcher.ItchSourceName}
+	if sourcesStr := os.Getenv("SOURCES"); sourcesStr != "" {
+		names = strings.Split(sourcesStr, ",")
 	}
+	logging.Info("SOURCES: %v", names)
+	return newSources(f, names)
+}
 
-	go func() {
-		fetchAndStoreAssets()
-	}()
+// newSources builds the named sources. Every source but "itch" must be
+// described in the JSON file named by SOURCES_FILE, as a list of
+// fetcher.HTMLSourceConfig.
+func newSources(f *fetcher.Fetcher, names []string) ([]fetcher.Source, error) {
+	configs := make(map[string]fetcher.HTMLSourceConfig)
+	if sourcesFile := os.Getenv("SOURCES_FILE"); sourcesFile != "" {
+		logging.Info("SOURCES_FILE: %s", sourcesFile)
+		data, err := os.ReadFile(sourcesFile)
+		if err != nil {
+			return nil, err
+		}
+		var list []fetcher.HTMLSourceConfig
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", sourcesFile, err)
+		}
+		for _, cfg := range list {
+			configs[cfg.Name] = cfg
+		}
+	}
 
-	// Respond to indicate the process has started
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "Asset fetch and store initiated")
+	var sources []fetcher.Source
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == fetcher.ItchSourceName {
+			sources = append(sources, fetcher.NewItchSource(f, ""))
+			continue
+		}
+		cfg, ok := configs[name]
+		if !ok {
+			return nil, fmt.Errorf("source %s is not described in SOURCES_FILE", name)
+		}
+		source, err := fetcher.NewHTMLSource(f, cfg)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
 }
 
-func fetchAndStoreAssets() {
-	// FETCHING ASSETS
-	assetCount, err := fetcher.GetAssetCount()
+// newVerifierFromEnv builds the verifier of the admin routes. Requests are
+// either signed with the shared secret in AUTH_HMAC_SECRET, or carry an OIDC
+// token that is checked against the JWKS file or URL in AUTH_JWKS and must be
+// for AUTH_AUDIENCE, and, if set, from AUTH_ISSUER for one of the comma
+// separated AUTH_EMAILS. Without any of them, only local runs are accepted.
+func newVerifierFromEnv(ctx context.Context) (*auth.Verifier, error) {
+	var cfg auth.Config
+	if secret := os.Getenv("AUTH_HMAC_SECRET"); secret != "" {
+		cfg.HMACSecret = []byte(secret)
+		logging.Info("AUTH_HMAC_SECRET: set")
+	}
+	if jwks := os.Getenv("AUTH_JWKS"); jwks != "" {
+		logging.Info("AUTH_JWKS: %s", jwks)
+		keys, err := auth.NewKeySet(ctx, jwks)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Keys = keys
+		cfg.Audience = os.Getenv("AUTH_AUDIENCE")
+		cfg.Issuer = os.Getenv("AUTH_ISSUER")
+		if emails := os.Getenv("AUTH_EMAILS"); emails != "" {
+			cfg.Emails = splitList(emails)
+		}
+		logging.Info("AUTH_AUDIENCE: %s, AUTH_ISSUER: %s, AUTH_EMAILS: %v", cfg.Audience, cfg.Issuer, cfg.Emails)
+	}
+	if cfg.HMACSecret == nil && cfg.Keys == nil && os.Getenv("RUN_LOCAL") == "true" {
+		logging.Warning("No authentication configured, accepting every request since RUN_LOCAL is set")
+		cfg.AllowUnauthenticated = true
+	}
+
+	verifier, err := auth.NewVerifier(cfg)
 	if err != nil {
-		logging.Fatal("Failed to get asset count: %v", err)
-	}
-
-	// fetch the first page to get the number of items per page
-	respData, ok := fetcher.FetchAssetPage(1)
-	if !ok {
-		logging.Fatal("Failed to fetch first page, terminating.")
-	}
-
-	nPages := int64(math.Ceil(float64(assetCount) / float64(respData.NumItems)))
-
-	var wg sync.WaitGroup
-	assetsChan := make(chan []models.Asset, int(nPages))
-
-	var pagesFetched atomic.Int64
-	var pagesInProgress atomic.Int64
-
-	for i := int64(1); i <= nPages; i++ {
-		wg.Add(1)
-		go func(pageNum int64) {
-			defer pagesFetched.Add(1)
-			defer pagesInProgress.Add(-1)
-			defer wg.Done()
-			pagesInProgress.Add(1)
-			time.Sleep(time.Second * time.Duration(rand.Int63n(nPages/9+1))) // this spreads out the requests
-			data, ok := fetcher.FetchAssetPage(pageNum)
-			if !ok {
-				return
-			}
-			assets, err := fetcher.ParseAssetPage(data, pageNum) // we include pageNum, as it indicates popularity
-			if err != nil {
-				logging.Error("Failed to parse asset page: %v", err)
-				return
-			}
-			assetsChan <- assets
-		}(i)
-	}
-
-	// every 5 seconds, print the progress
-	quitProgressLog := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-quitProgressLog:
-				return
-			default:
-				time.Sleep(5 * time.Second)
-				logging.Info("Pages fetched: %d/%d, in progress: %d", pagesFetched.Load(), nPages, pagesInProgress.Load())
-			}
+		return nil, err
+	}
+	if !verifier.Enabled() {
+		logging.Error("No authentication configured, every request will be rejected")
+	}
+	return verifier, nil
+}
+
+// runs starts the crawls of this service, configured in main.
+var runs *runManager
+
+// crawlDetails enables the second crawl stage, which visits the page of every
+// asset to fill in tags, ratings, files and so on. Taken from CRAWL_DETAILS.
+var crawlDetails bool
+
+// crawlTimeout is the total time budget of a single crawl, taken from
+// CRAWL_TIMEOUT. Zero means there is no limit.
+var crawlTimeout time.Duration
+
+// configureStorageFromEnv sets up where the snapshots are kept. STORAGE_DIR
+// keeps them in a local directory instead of the bucket, SNAPSHOT_KEEP and
+// SNAPSHOT_MAX_AGE set how long they are kept.
+func configureStorageFromEnv() {
+	if storageDir := os.Getenv("STORAGE_DIR"); storageDir != "" {
+		logging.Info("STORAGE_DIR: %s", storageDir)
+		storage.UseDir(storageDir)
+	}
+
+	if keepStr := os.Getenv("SNAPSHOT_KEEP"); keepStr != "" {
+		keep, err := strconv.Atoi(keepStr)
+		if err != nil || keep < 1 {
+			logging.Fatal("Invalid SNAPSHOT_KEEP, must be at least 1: %s", keepStr)
 		}
-	}()
+		snapshotKeep = keep
+	}
+	logging.Info("SNAPSHOT_KEEP: %d", snapshotKeep)
 
-	// close the channel when all the assets are fetched.
-	// we do this in a goroutine so that we don't block the main thread
-	go func() {
-		wg.Wait()
-		quitProgressLog <- true
-		close(assetsChan)
-	}()
+	if maxAgeStr := os.Getenv("SNAPSHOT_MAX_AGE"); maxAgeStr != "" {
+		maxAge, err := time.ParseDuration(maxAgeStr)
+		if err != nil || maxAge < 0 {
+			logging.Fatal("Invalid SNAPSHOT_MAX_AGE: %s", maxAgeStr)
+		}
+		snapshotMaxAge = maxAge
+	}
+	logging.Info("SNAPSHOT_MAX_AGE: %v", snapshotMaxAge)
+}
 
-	var assets []models.Asset
-	for assetPage := range assetsChan {
-		assets = append(assets, assetPage...)
+// splitList splits a comma separated setting into its entries, without
+// surrounding spaces and leaving out empty ones.
+func splitList(s string) []string {
+	var entries []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
 	}
-	logging.Info("Successfully fetched %d assets", len(assets))
+	return entries
+}
+
+// configureFromEnv sets up the crawl settings shared by the server and the
+// crawl command from the environment.
+func configureFromEnv() {
+	configureStorageFromEnv()
 
-	// CREATING INDEX
-	logging.Info("Creating index...")
-	newIndexMapping := bleve.NewIndexMapping() // TODO: customize as needed
-	newIndex, err := bleve.New(storage.IndexDirName, newIndexMapping)
-	defer os.RemoveAll(storage.IndexDirName) // After we are done, no matter if clean or with error, we remove the index, since it is uploaded to storage.
+	itch = newFetcherFromEnv()
+	var err error
+	sources, err = newSourcesFromEnv(itch)
 	if err != nil {
-		logging.Error("Failed to create index: %v", err)
-		return
+		logging.Fatal("Invalid sources: %v", err)
+	}
+
+	if workersStr := os.Getenv("CRAWL_WORKERS"); workersStr != "" {
+		workers, err := strconv.Atoi(workersStr)
+		if err != nil || workers < 1 {
+			logging.Error("Invalid CRAWL_WORKERS, defaulting to %d: %s", crawlWorkers, workersStr)
+		} else {
+			crawlWorkers = workers
+		}
+	}
+	logging.Info("CRAWL_WORKERS: %d", crawlWorkers)
+
+	crawlDetails = os.Getenv("CRAWL_DETAILS") == "true"
+	logging.Info("CRAWL_DETAILS: %v", crawlDetails)
+
+	mirrorThumbs = os.Getenv("MIRROR_THUMBS") == "true"
+	logging.Info("MIRROR_THUMBS: %v", mirrorThumbs)
+
+	hashThumbs = os.Getenv("HASH_THUMBS") == "true"
+	logging.Info("HASH_THUMBS: %v", hashThumbs)
+
+	paletteThumbs = os.Getenv("PALETTE_THUMBS") == "true"
+	logging.Info("PALETTE_THUMBS: %v", paletteThumbs)
+
+	if check := os.Getenv("DRIFT_CHECK"); check != "" {
+		if check != driftCheckFail && check != driftCheckWarn {
+			logging.Fatal("Invalid DRIFT_CHECK, must be %q or %q: %s", driftCheckFail, driftCheckWarn, check)
+		}
+		driftCheck = check
 	}
+	logging.Info("DRIFT_CHECK: %s", driftCheck)
 
-	logging.Info("Created new empty index at %s", storage.IndexDirName)
+	if minAssetsStr := os.Getenv("PUBLISH_MIN_ASSETS"); minAssetsStr != "" {
+		minAssets, err := strconv.ParseInt(minAssetsStr, 10, 64)
+		if err != nil || minAssets < 0 {
+			logging.Fatal("Invalid PUBLISH_MIN_ASSETS: %s", minAssetsStr)
+		}
+		publishMinAssets = minAssets
+	}
+	logging.Info("PUBLISH_MIN_ASSETS: %d", publishMinAssets)
 
-	// first, convert the assets to IndexedAssets, which are smaller and used for indexing
-	var smolAssets []models.IndexedAsset = make([]models.IndexedAsset, len(assets))
-	for i, asset := range assets {
-		smolAssets[i] = models.IndexedAsset{
-			GameId:        asset.GameId,
-			Title:         asset.Title,
-			Author:        asset.Author,
-			Description:   asset.Description,
-			InvPopularity: asset.InvPopularity,
+	if maxDropStr := os.Getenv("PUBLISH_MAX_DROP"); maxDropStr != "" {
+		maxDrop, err := strconv.ParseFloat(maxDropStr, 64)
+		if err != nil || maxDrop < 0 || maxDrop > 100 {
+			logging.Fatal("Invalid PUBLISH_MAX_DROP, must be a percentage: %s", maxDropStr)
 		}
+		publishMaxDrop = maxDrop
 	}
+	logging.Info("PUBLISH_MAX_DROP: %v%%", publishMaxDrop)
 
-	// indexing the assets in batches
-	b := newIndex.NewBatch()
-	assetsIndexed := 0
-	for i, asset := range smolAssets {
-		assetsIndexed += 1
-		err := b.Index(asset.GameId, asset)
+	if fillRatesStr, ok := os.LookupEnv("PUBLISH_MIN_FILL_RATES"); ok {
+		fillRates, err := parseFillRates(fillRatesStr)
 		if err != nil {
-			newIndex.Close() // clean up the failed new index
-			logging.Error("Failed to index asset, cancelling indexing: %v", err)
-			return
+			logging.Fatal("Invalid PUBLISH_MIN_FILL_RATES: %v", err)
 		}
-		if i%1500 == 0 && i != 0 { // we index in batches of 1500
-			logging.Info("Batching assets: %d/%d", i, len(smolAssets))
-			newIndex.Batch(b)
-			b.Reset()
+		publishMinFillRates = fillRates
+	}
+	logging.Info("PUBLISH_MIN_FILL_RATES: %+v", publishMinFillRates)
+
+	if facets := os.Getenv("CRAWL_FACETS"); facets != "" {
+		facetListings = splitList(facets)
+	}
+	logging.Info("CRAWL_FACETS: %v", facetListings)
+
+	if listings := os.Getenv("INCREMENTAL_LISTINGS"); listings != "" {
+		incrementalListings = splitList(listings)
+	}
+	logging.Info("INCREMENTAL_LISTINGS: %v", incrementalListings)
+
+	if intervalStr := os.Getenv("FULL_CRAWL_INTERVAL"); intervalStr != "" {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			logging.Fatal("Invalid FULL_CRAWL_INTERVAL: %v", err)
 		}
+		fullCrawlInterval = interval
 	}
-	newIndex.Batch(b) // batch the remaining assets into the index
-	newIndex.Close()  // close the index
-	logging.Info("Successfully indexed %d assets", assetsIndexed)
+	logging.Info("FULL_CRAWL_INTERVAL: %v", fullCrawlInterval)
 
-	// STORING INDEX
-	logging.Info("Storing index in cloud storage file")
-	dir, err := os.ReadDir(storage.IndexDirName)
-	if err != nil {
-		logging.Error("Failed to read dir: %v", err)
+	if jitterStr := os.Getenv("SCHEDULE_JITTER"); jitterStr != "" {
+		jitter, err := time.ParseDuration(jitterStr)
+		if err != nil || jitter < 0 {
+			logging.Fatal("Invalid SCHEDULE_JITTER: %s", jitterStr)
+		}
+		scheduleJitter = jitter
+	}
+	logging.Info("SCHEDULE_JITTER: %v", scheduleJitter)
+
+	if timeoutStr := os.Getenv("CRAWL_TIMEOUT"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			logging.Fatal("Invalid CRAWL_TIMEOUT: %v", err)
+		}
+		crawlTimeout = timeout
+		logging.Info("CRAWL_TIMEOUT: %v", crawlTimeout)
+	}
+}
+
+func main() {
+	logging.Init("", true)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
 	}
-	for _, entry := range dir {
-		logging.Info("DEBUG: entry: %s", entry.Name())
+	configureFromEnv()
+
+	// cloud run sends SIGTERM before reclaiming an instance, this cancels
+	// the running crawl.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runs = newRunManager(ctx, fetchAndStoreAssets, crawlTimeout)
+
+	// FULL_CRAWL_SCHEDULE and INCREMENTAL_CRAWL_SCHEDULE start runs without
+	// an external scheduler calling /trigger-fetch
+	for mode, env := range map[string]string{modeFull: "FULL_CRAWL_SCHEDULE", modeIncremental: "INCREMENTAL_CRAWL_SCHEDULE"} {
+		spec := os.Getenv(env)
+		if spec == "" {
+			continue
+		}
+		logging.Info("%s: %s", env, spec)
+		sched, err := parseSchedule(mode, spec, scheduleJitter)
+		if err != nil {
+			logging.Fatal("Invalid %s: %v", env, err)
+		}
+		go sched.run(ctx, runs)
 	}
 
-	err = storage.PutFS(storage.IndexDirName, storage.IndexArchiveName)
+	verifier, err := newVerifierFromEnv(ctx)
 	if err != nil {
-		logging.Error("Failed to put index: %v", err)
+		logging.Fatal("Invalid authentication settings: %v", err)
+	}
+
+	// every route of this service is an admin route
+	r := chi.NewRouter()
+	r.Use(verifier.Middleware)
+	r.Post("/trigger-fetch", handleFetchTrigger)
+	r.Post("/cancel-fetch", handleFetchCancel)
+	r.Get("/runs", handleListRuns)
+	r.Get("/runs/{id}", handleGetRun)
+	r.Post("/runs/{id}/cancel", handleCancelRun)
+	r.Get("/snapshots", handleListSnapshots)
+	r.Post("/snapshots/{id}/rollback", handleRollbackSnapshot)
+	port := fmt.Sprintf(":%s", os.Getenv("PORT")) // as per cloud run standard
+	if port == ":" {
+		port = ":8080"
+	}
+	server := &http.Server{Addr: port, Handler: r}
+	go func() {
+		<-ctx.Done()
+		logging.Info("Shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logging.Info("Server listening on port %s", port)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logging.Fatal("Server failed to start: %v", err)
+	}
+
+	// cloud run kills the instance 10 seconds after SIGTERM
+	if !runs.wait(8 * time.Second) {
+		logging.Warning("Crawls did not stop in time, exiting anyway")
+	}
+}
+
+// writeJSON responds with v as JSON.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Error("Failed to write response: %v", err)
+	}
+}
+
+// handleFetchTrigger starts a crawl and responds with its run. Only one run
+// can be active at a time, a trigger during a run gets that run back with a
+// conflict status.
+func handleFetchTrigger(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = modeFull
+	}
+	if mode != modeFull && mode != modeIncremental {
+		http.Error(w, "Unknown crawl mode", http.StatusBadRequest)
+		return
+	}
+
+	run, err := runs.start(mode, triggerHTTP)
+	if errors.Is(err, errRunActive) {
+		writeJSON(w, http.StatusConflict, run)
 		return
 	}
-	logging.Info("Successfully stored index")
+	writeJSON(w, http.StatusOK, run)
+}
 
-	// STORING ASSETS
-	logging.Info("Storing assets in cloud storage file")
-	err = storage.PutAssets(assets)
+// handleFetchCancel cancels the active run, if any.
+func handleFetchCancel(w http.ResponseWriter, r *http.Request) {
+	run, err := runs.cancelRun("")
+	if errors.Is(err, errRunNotFound) || errors.Is(err, errRunNotRunning) {
+		http.Error(w, "No run in progress", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+func handleListRuns(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, runs.list())
+}
+
+func handleGetRun(w http.ResponseWriter, r *http.Request) {
+	run, err := runs.get(chi.URLParam(r, "id"))
 	if err != nil {
-		logging.Error("Failed to put assets, stopping here and not putting index: %v", err)
+		http.Error(w, "Run not found", http.StatusNotFound)
 		return
 	}
-	logging.Info("Successfully stored assets")
+	writeJSON(w, http.StatusOK, run)
+}
 
+func handleCancelRun(w http.ResponseWriter, r *http.Request) {
+	run, err := runs.cancelRun(chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, errRunNotFound):
+		http.Error(w, "Run not found", http.StatusNotFound)
+	case errors.Is(err, errRunNotRunning):
+		writeJSON(w, http.StatusConflict, run)
+	default:
+		writeJSON(w, http.StatusOK, run)
+	}
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/logging"
+	"itchgrep/pkg/models"
+	"sync"
+)
+
+// pipelineQueueSize bounds how many assets wait between two stages of the
+// pipeline. A slow stage holds up the ones before it instead of letting
+// assets pile up in memory.
+const pipelineQueueSize = 1000
+
+// pipeline carries the assets of a crawl from the fetch workers, which
+// fetch and parse the listing pages, through the asset stage, which fills in
+// facets, details and thumbnails on crawlWorkers workers, into a
+// snapshotWriter. All stages run at the same time, so the snapshot grows
+// while the crawl is still running. Of the assets that passed through, only
+// their GameIds are kept, to drop those that are listed twice.
+type pipeline struct {
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	writer   *snapshotWriter
+	recorder *fetcher.ReportRecorder
+
+	// facets are the facets of each GameId, which are applied if not nil.
+	facets map[string][]string
+	// fetchDetails enables fetching the details of every asset.
+	fetchDetails bool
+	// checkpoint, which may be nil, records the written assets of the pages
+	// given to addPage.
+	checkpoint *checkpointer
+
+	detailSources map[string]fetcher.DetailSource
+	thumbs        map[string]models.Asset // see previousThumbs
+
+	mu   sync.Mutex
+	seen map[string]bool // GameIds that were added already
+
+	queue   chan models.Asset
+	done    chan models.Asset
+	workers sync.WaitGroup
+	written chan error
+}
+
+// newPipeline creates a pipeline that writes to writer. Its options have to
+// be set before it is started. Its context is cancelled when writing fails.
+func newPipeline(ctx context.Context, writer *snapshotWriter, recorder *fetcher.ReportRecorder) *pipeline {
+	p := &pipeline{
+		writer:        writer,
+		recorder:      recorder,
+		detailSources: make(map[string]fetcher.DetailSource),
+		seen:          make(map[string]bool),
+		queue:         make(chan models.Asset, pipelineQueueSize),
+		done:          make(chan models.Asset, pipelineQueueSize),
+		written:       make(chan error, 1),
+	}
+	p.ctx, p.cancel = context.WithCancelCause(ctx)
+	for _, source := range sources {
+		if detailSource, ok := source.(fetcher.DetailSource); ok {
+			p.detailSources[source.Name()] = detailSource
+		}
+	}
+	return p
+}
+
+// start starts the asset stage and the writer.
+func (p *pipeline) start() {
+	if processThumbs() {
+		p.thumbs = previousThumbs(p.ctx)
+	}
+
+	for i := 0; i < max(crawlWorkers, 1); i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for asset := range p.queue {
+				p.process(&asset)
+				p.done <- asset
+			}
+		}()
+	}
+
+	go func() {
+		var err error
+		for asset := range p.done {
+			if err != nil {
+				continue // drain, so that the asset stage never blocks
+			}
+			if err = p.writer.write(asset); err != nil {
+				p.cancel(err)
+				continue
+			}
+			p.checkpoint.written(asset)
+		}
+		p.written <- err
+	}()
+	logging.Info("Started pipeline with %d asset workers", max(crawlWorkers, 1))
+}
+
+// add hands assets to the pipeline. Assets whose GameId was added before
+// are dropped, since a listing can shift while it is crawled. It blocks
+// while the pipeline is full, and returns an error once the pipeline was
+// cancelled.
+func (p *pipeline) add(assets ...models.Asset) error {
+	return p.enqueue(p.unseen(assets), p.queue)
+}
+
+// addPage hands the assets found on a listing page to the pipeline like add,
+// and records them in the checkpoint, which completes the page once all of
+// them were written.
+func (p *pipeline) addPage(source string, pageNum int64, assets []models.Asset) error {
+	unseen := p.unseen(assets)
+	gameIds := make([]string, len(unseen))
+	for i, asset := range unseen {
+		gameIds[i] = asset.GameId
+	}
+	p.checkpoint.pageFetched(source, pageNum, gameIds)
+	return p.enqueue(unseen, p.queue)
+}
+
+// addProcessed hands assets that already went through the asset stage, such
+// as those an earlier attempt of the run wrote, straight to the writer. Only
+// their facets are applied again, since more facet listing pages may have
+// been crawled since.
+func (p *pipeline) addProcessed(assets ...models.Asset) error {
+	unseen := p.unseen(assets)
+	if p.facets != nil {
+		for i := range unseen {
+			unseen[i].Facets = p.facets[unseen[i].GameId]
+		}
+	}
+	return p.enqueue(unseen, p.done)
+}
+
+// unseen returns the assets whose GameId was not added before, and marks
+// them as added.
+func (p *pipeline) unseen(assets []models.Asset) []models.Asset {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var unseen []models.Asset
+	for _, asset := range assets {
+		if !p.seen[asset.GameId] {
+			p.seen[asset.GameId] = true
+			unseen = append(unseen, asset)
+		}
+	}
+	return unseen
+}
+
+// enqueue sends assets to the given stage of the pipeline, blocking while it
+// is full.
+func (p *pipeline) enqueue(assets []models.Asset, stage chan<- models.Asset) error {
+	for _, asset := range assets {
+		select {
+		case <-p.ctx.Done():
+			return context.Cause(p.ctx)
+		case stage <- asset:
+		}
+	}
+	return nil
+}
+
+// finish waits for all assets that were added to be written, which the
+// caller must not add to anymore. It returns an error if the pipeline was
+// cancelled, in which case the snapshot is incomplete.
+func (p *pipeline) finish() error {
+	close(p.queue)
+	p.workers.Wait()
+	close(p.done)
+	if err := <-p.written; err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	err := context.Cause(p.ctx) // nil unless cancelled
+	p.cancel(nil)
+	return err
+}
+
+// process fills in the facets, details and thumbnail of a single asset, as
+// far as enabled. Failures are recorded in the report, the asset is kept
+// with what could be found out about it.
+func (p *pipeline) process(asset *models.Asset) {
+	if p.ctx.Err() != nil {
+		return // it is thrown away anyway
+	}
+
+	if p.facets != nil {
+		asset.Facets = p.facets[asset.GameId]
+	}
+
+	if detailSource := p.detailSources[fetcher.SourceOf(*asset)]; p.fetchDetails && detailSource != nil {
+		details, err := detailSource.FetchDetails(p.ctx, *asset)
+		if err == nil {
+			details.Apply(asset)
+			p.recorder.DetailSucceeded()
+		} else if p.ctx.Err() == nil {
+			logging.Warning("Failed to fetch details of asset %s: %v", asset.GameId, err)
+			p.recorder.DetailFailed(err)
+		}
+	}
+
+	if processThumbs() && asset.ThumbUrl != "" {
+		if thumbDone(*asset) {
+			// carried over from the previous snapshot
+			p.recorder.ThumbProcessed(true)
+		} else if previous, ok := p.thumbs[asset.ThumbUrl]; ok {
+			copyThumb(asset, previous)
+			p.recorder.ThumbProcessed(true)
+		} else if err := processThumbnail(p.ctx, asset); err == nil {
+			p.recorder.ThumbProcessed(false)
+		} else if p.ctx.Err() == nil {
+			logging.Warning("Failed to process thumbnail of asset %s: %v", asset.GameId, err)
+			p.recorder.ThumbFailed(err)
+		}
+	}
+}
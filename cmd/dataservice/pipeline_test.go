@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"os"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSnapshot streams assets through a pipeline into a new snapshot and
+// publishes it.
+func writeSnapshot(t *testing.T, snapshotId string, facets map[string][]string, assets ...models.Asset) *snapshotWriter {
+	ctx := context.Background()
+	writer, err := newSnapshotWriter(ctx, snapshotId)
+	require.NoError(t, err)
+	defer writer.discard()
+
+	recorder := fetcher.NewReportRecorder(0)
+	p := newPipeline(ctx, writer, recorder)
+	p.facets = facets
+	p.start()
+	require.NoError(t, p.add(assets...))
+	require.NoError(t, p.finish())
+	require.NoError(t, writer.publish(ctx, recorder.Finish(writer.count)))
+	return writer
+}
+
+func TestPipelineWritesSnapshot(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+	previousBatchSize := indexBatchSize
+	defer func() { indexBatchSize = previousBatchSize }()
+	indexBatchSize = 4
+
+	var assets []models.Asset
+	for i := 0; i < indexBatchSize+10; i++ {
+		assets = append(assets, models.Asset{GameId: fmt.Sprint(i), Title: "Asset", Link: "https://example.com"})
+	}
+	assets = append(assets, assets[0]) // listed twice
+	writer := writeSnapshot(t, "run-1", facetsById(map[string][]string{"free": {"1", "1"}}), assets...)
+	assert.Equal(t, indexBatchSize+10, writer.count)
+	assert.Equal(t, 1.0, writer.fill.Rates().Title)
+
+	manifest, err := storage.GetManifest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, models.Manifest{SnapshotId: "run-1", PublishedAt: manifest.PublishedAt, AssetCount: indexBatchSize + 10}, manifest)
+	stored, err := storage.GetAssets(ctx, "run-1")
+	require.NoError(t, err)
+	require.Len(t, stored, indexBatchSize+10)
+	byId := make(map[string]models.Asset)
+	for _, asset := range stored {
+		byId[asset.GameId] = asset
+	}
+	assert.Equal(t, []string{"free"}, byId["1"].Facets)
+	assert.Nil(t, byId["2"].Facets)
+	_, err = storage.GetChanges(ctx, "run-1")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "the first snapshot has nothing to compare to")
+
+	// every asset made it into the index
+	dir := t.TempDir()
+	indexPath, err := storage.GetIndex(ctx, "run-1", dir)
+	require.NoError(t, err)
+	index, err := bleve.Open(indexPath)
+	require.NoError(t, err)
+	count, err := index.DocCount()
+	index.Close()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(indexBatchSize+10), count)
+
+	// the next snapshot is compared to the first
+	writeSnapshot(t, "run-2", nil, models.Asset{GameId: "0", Title: "Renamed"}, models.Asset{GameId: "new"})
+	changes, err := storage.GetChanges(ctx, "run-2")
+	require.NoError(t, err)
+	assert.Equal(t, "run-1", changes.PreviousSnapshotId)
+	assert.Equal(t, []models.AssetRef{{GameId: "new"}}, changes.Added)
+	assert.Equal(t, indexBatchSize+9, len(changes.Removed))
+	require.Len(t, changes.Edited, 1)
+	assert.Equal(t, "0", changes.Edited[0].GameId)
+
+	_, err = os.Stat(writer.dir)
+	assert.ErrorIs(t, err, os.ErrNotExist, "the local files are removed")
+}
+
+func TestPipelineStopsWhenCancelled(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx, cancel := context.WithCancelCause(context.Background())
+	writer, err := newSnapshotWriter(ctx, "run-1")
+	require.NoError(t, err)
+	defer writer.discard()
+
+	p := newPipeline(ctx, writer, fetcher.NewReportRecorder(0))
+	p.start()
+	require.NoError(t, p.add(models.Asset{GameId: "1"}))
+	cancel(errCancelledByAdmin)
+	for i := 0; i < 2*pipelineQueueSize; i++ {
+		if err = p.add(models.Asset{GameId: fmt.Sprint("more-", i)}); err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, errCancelledByAdmin, "adding to a cancelled pipeline does not block")
+	assert.ErrorIs(t, p.finish(), errCancelledByAdmin)
+}
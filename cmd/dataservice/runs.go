@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/logging"
+	"itchgrep/pkg/models"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxRunHistory is how many runs the run manager remembers, including the
+// active one.
+const maxRunHistory = 50
+
+// What started a run, see models.Run.
+const (
+	triggerHTTP     = "http"
+	triggerSchedule = "schedule"
+)
+
+var (
+	errRunActive     = errors.New("a run is already in progress")
+	errRunNotFound   = errors.New("run not found")
+	errRunNotRunning = errors.New("run is not running")
+)
+
+// crawlFunc runs a crawl, see fetchAndStoreAssets.
+type crawlFunc func(ctx context.Context, runId string, mode string, recorder *fetcher.ReportRecorder) error
+
+// run is a crawl started by the run manager, with what is needed to follow
+// and cancel it. Its fields are guarded by the lock of the manager.
+type run struct {
+	status   models.Run
+	recorder *fetcher.ReportRecorder
+	cancel   context.CancelCauseFunc
+}
+
+// runManager starts crawls one at a time and keeps track of their state.
+// Every crawl builds its snapshot in a directory of its own, but they all
+// resume the same checkpoints and point the same manifest at what they
+// publish, so two of them must never run at once.
+type runManager struct {
+	mu      sync.Mutex
+	base    context.Context // cancelling it stops the active run
+	crawl   crawlFunc
+	timeout time.Duration // zero means no limit
+	active  *run
+	history []*run // oldest first
+
+	running sync.WaitGroup // lets shutdown wait for the run to save its progress
+}
+
+func newRunManager(base context.Context, crawl crawlFunc, timeout time.Duration) *runManager {
+	return &runManager{base: base, crawl: crawl, timeout: timeout}
+}
+
+// start starts a crawl in the given mode in the background. If a run is
+// already active, it returns errRunActive along with that run.
+func (m *runManager) start(mode, trigger string) (models.Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active != nil {
+		return m.snapshot(m.active), errRunActive
+	}
+
+	// the crawl outlives the request, so it must not use the request context
+	ctx, cancel := context.WithCancelCause(m.base)
+	crawlCtx, cancelTimeout := ctx, context.CancelFunc(func() {})
+	if m.timeout > 0 {
+		crawlCtx, cancelTimeout = context.WithTimeout(ctx, m.timeout)
+	}
+
+	r := &run{
+		status: models.Run{
+			Id:        newRunId(),
+			Mode:      mode,
+			Trigger:   trigger,
+			State:     models.RunRunning,
+			StartedAt: time.Now().UTC(),
+		},
+		recorder: fetcher.NewReportRecorder(0),
+		cancel:   cancel,
+	}
+	m.active = r
+	m.history = append(m.history, r)
+	if len(m.history) > maxRunHistory {
+		m.history = slices.Delete(m.history, 0, len(m.history)-maxRunHistory)
+	}
+	logging.Info("Starting run %s in %s mode, triggered by %s", r.status.Id, mode, trigger)
+
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		defer cancel(nil)
+		defer cancelTimeout()
+		err := m.runCrawl(crawlCtx, r)
+		m.finish(crawlCtx, r, err)
+	}()
+	return m.snapshot(r), nil
+}
+
+// runCrawl runs the crawl of r, turning a panic into an error so that a bug
+// in a single run does not take down the service.
+func (m *runManager) runCrawl(ctx context.Context, r *run) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logging.Error("Run %s panicked: %v\n%s", r.status.Id, p, debug.Stack())
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return m.crawl(ctx, r.status.Id, r.status.Mode, r.recorder)
+}
+
+// finish records the outcome of r and lets the next run start.
+func (m *runManager) finish(ctx context.Context, r *run, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	finishedAt := time.Now().UTC()
+	r.status.FinishedAt = &finishedAt
+	switch {
+	case err == nil:
+		r.status.State = models.RunSucceeded
+		logging.Info("Run %s succeeded", r.status.Id)
+	case errors.Is(context.Cause(ctx), errCancelledByAdmin):
+		r.status.State = models.RunCancelled
+		r.status.Error = err.Error()
+		logging.Info("Run %s was cancelled: %v", r.status.Id, err)
+	default:
+		r.status.State = models.RunFailed
+		r.status.Error = err.Error()
+		logging.Error("Run %s failed: %v", r.status.Id, err)
+	}
+	if m.active == r {
+		m.active = nil
+	}
+}
+
+// snapshot returns the status of r with its current progress. The caller
+// must hold m.mu.
+func (m *runManager) snapshot(r *run) models.Run {
+	status := r.status
+	status.Progress = r.recorder.Progress()
+	return status
+}
+
+// list returns every remembered run, the newest first.
+func (m *runManager) list() []models.Run {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := make([]models.Run, 0, len(m.history))
+	for i := len(m.history) - 1; i >= 0; i-- {
+		runs = append(runs, m.snapshot(m.history[i]))
+	}
+	return runs
+}
+
+// get returns the run with the given ID.
+func (m *runManager) get(id string) (models.Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.history {
+		if r.status.Id == id {
+			return m.snapshot(r), nil
+		}
+	}
+	return models.Run{}, errRunNotFound
+}
+
+// cancelRun stops the run with the given ID and throws away its checkpoint.
+// The run stays in the running state until the crawl has stopped. An empty
+// id cancels the active run, if any.
+func (m *runManager) cancelRun(id string) (models.Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id == "" && m.active != nil {
+		id = m.active.status.Id
+	}
+	for _, r := range m.history {
+		if r.status.Id != id {
+			continue
+		}
+		if r != m.active {
+			return m.snapshot(r), errRunNotRunning
+		}
+		r.cancel(errCancelledByAdmin)
+		logging.Info("Cancelling run %s", id)
+		return m.snapshot(r), nil
+	}
+	return models.Run{}, errRunNotFound
+}
+
+// wait waits up to timeout for the active run to stop, and reports whether
+// it did.
+func (m *runManager) wait(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"itchgrep/internal/fetcher"
+	"itchgrep/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForState polls the run with the given ID until it left the running
+// state.
+func waitForState(t *testing.T, m *runManager, id string) models.Run {
+	require.Eventually(t, func() bool {
+		run, err := m.get(id)
+		return err == nil && run.State != models.RunRunning
+	}, time.Second, time.Millisecond)
+	run, _ := m.get(id)
+	return run
+}
+
+func TestRunManagerAllowsOneActiveRun(t *testing.T) {
+	release := make(chan bool)
+	m := newRunManager(context.Background(), func(ctx context.Context, runId, mode string, recorder *fetcher.ReportRecorder) error {
+		recorder.AddPagesTotal(3)
+		<-release
+		return nil
+	}, 0)
+
+	first, err := m.start(modeFull, triggerHTTP)
+	require.NoError(t, err)
+	assert.Equal(t, models.RunRunning, first.State)
+
+	active, err := m.start(modeIncremental, triggerHTTP)
+	assert.ErrorIs(t, err, errRunActive)
+	assert.Equal(t, first.Id, active.Id)
+
+	close(release)
+	run := waitForState(t, m, first.Id)
+	assert.Equal(t, models.RunSucceeded, run.State)
+	assert.Equal(t, int64(3), run.Progress.PagesTotal)
+	assert.NotNil(t, run.FinishedAt)
+
+	second, err := m.start(modeIncremental, triggerHTTP)
+	require.NoError(t, err)
+	waitForState(t, m, second.Id)
+	runs := m.list()
+	require.Len(t, runs, 2)
+	assert.Equal(t, second.Id, runs[0].Id, "runs should be listed newest first")
+}
+
+func TestRunManagerRecordsFailures(t *testing.T) {
+	m := newRunManager(context.Background(), func(ctx context.Context, runId, mode string, recorder *fetcher.ReportRecorder) error {
+		if mode == modeIncremental {
+			panic("oops")
+		}
+		return errors.New("source is down")
+	}, 0)
+
+	run, err := m.start(modeFull, triggerHTTP)
+	require.NoError(t, err)
+	run = waitForState(t, m, run.Id)
+	assert.Equal(t, models.RunFailed, run.State)
+	assert.Equal(t, "source is down", run.Error)
+
+	run, err = m.start(modeIncremental, triggerHTTP)
+	require.NoError(t, err)
+	run = waitForState(t, m, run.Id)
+	assert.Equal(t, models.RunFailed, run.State)
+	assert.Contains(t, run.Error, "panic")
+}
+
+func TestRunManagerCancel(t *testing.T) {
+	m := newRunManager(context.Background(), func(ctx context.Context, runId, mode string, recorder *fetcher.ReportRecorder) error {
+		<-ctx.Done()
+		return context.Cause(ctx)
+	}, 0)
+
+	_, err := m.cancelRun("unknown")
+	assert.ErrorIs(t, err, errRunNotFound)
+
+	run, err := m.start(modeFull, triggerHTTP)
+	require.NoError(t, err)
+	_, err = m.cancelRun(run.Id)
+	require.NoError(t, err)
+	run = waitForState(t, m, run.Id)
+	assert.Equal(t, models.RunCancelled, run.State)
+
+	_, err = m.cancelRun(run.Id)
+	assert.ErrorIs(t, err, errRunNotRunning)
+	assert.True(t, m.wait(time.Second))
+}
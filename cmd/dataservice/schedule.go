@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"itchgrep/internal/logging"
+	"math/rand/v2"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// scheduleJitter is the largest random delay added to every scheduled run,
+// so that instances with the same schedule do not all crawl at once. Taken
+// from SCHEDULE_JITTER.
+var scheduleJitter = 10 * time.Minute
+
+// scheduleRetryInterval is how often a scheduled run that found another run
+// in progress tries again.
+const scheduleRetryInterval = time.Minute
+
+// schedule starts runs of one mode at the times of a cron expression.
+type schedule struct {
+	mode   string
+	spec   string
+	cron   cron.Schedule
+	jitter time.Duration
+	retry  time.Duration
+}
+
+// parseSchedule parses a standard five field cron expression, or one of the
+// descriptors such as "@daily" or "@every 6h".
+func parseSchedule(mode, spec string, jitter time.Duration) (*schedule, error) {
+	parsed, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s schedule %q: %w", mode, spec, err)
+	}
+	return &schedule{mode: mode, spec: spec, cron: parsed, jitter: jitter, retry: scheduleRetryInterval}, nil
+}
+
+// next returns when the schedule fires after t, including the jitter.
+func (s *schedule) next(t time.Time) time.Time {
+	next := s.cron.Next(t)
+	if s.jitter > 0 {
+		next = next.Add(rand.N(s.jitter))
+	}
+	return next
+}
+
+// run starts the runs of the schedule through runs until ctx is done.
+func (s *schedule) run(ctx context.Context, runs *runManager) {
+	logging.Info("Scheduling %s runs at %q with up to %v jitter", s.mode, s.spec, s.jitter)
+	for {
+		due := s.next(time.Now())
+		logging.Info("Next scheduled %s run at %v", s.mode, due)
+		if !sleepUntil(ctx, due) {
+			return
+		}
+		s.start(ctx, runs)
+	}
+}
+
+// start starts a run of the schedule. Only one run can be active at a time,
+// so if another is in progress, the run waits for it to finish, but no
+// longer than until the next time the schedule fires.
+func (s *schedule) start(ctx context.Context, runs *runManager) {
+	deadline := s.cron.Next(time.Now())
+	for {
+		run, err := runs.start(s.mode, triggerSchedule)
+		if err == nil {
+			logging.Info("Started scheduled %s run %s", s.mode, run.Id)
+			return
+		}
+		if !errors.Is(err, errRunActive) {
+			logging.Error("Failed to start scheduled %s run: %v", s.mode, err)
+			return
+		}
+		if time.Now().Add(s.retry).After(deadline) {
+			logging.Warning("Skipping scheduled %s run, run %s is still in progress", s.mode, run.Id)
+			return
+		}
+		if !sleepUntil(ctx, time.Now().Add(s.retry)) {
+			return
+		}
+	}
+}
+
+// sleepUntil waits until t, and reports false if ctx was done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"itchgrep/internal/fetcher"
+	"itchgrep/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleNextAddsJitter(t *testing.T) {
+	s, err := parseSchedule(modeFull, "0 3 * * *", 10*time.Minute)
+	require.NoError(t, err)
+	from := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	due := time.Date(2024, 3, 2, 3, 0, 0, 0, time.Local)
+	for i := 0; i < 20; i++ {
+		next := s.next(from)
+		assert.False(t, next.Before(due))
+		assert.True(t, next.Before(due.Add(10*time.Minute)))
+	}
+
+	_, err = parseSchedule(modeFull, "every day", 0)
+	assert.Error(t, err)
+}
+
+func TestScheduleWaitsForActiveRun(t *testing.T) {
+	release := make(chan bool)
+	m := newRunManager(context.Background(), func(ctx context.Context, runId, mode string, recorder *fetcher.ReportRecorder) error {
+		if mode == modeFull {
+			<-release
+		}
+		return nil
+	}, 0)
+	active, err := m.start(modeFull, triggerHTTP)
+	require.NoError(t, err)
+
+	s, err := parseSchedule(modeIncremental, "@every 1h", 0)
+	require.NoError(t, err)
+	s.retry = 10 * time.Millisecond
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	s.start(context.Background(), m)
+
+	runs := m.list()
+	require.Len(t, runs, 2)
+	assert.Equal(t, triggerSchedule, runs[0].Trigger)
+	assert.Equal(t, modeIncremental, runs[0].Mode)
+	assert.Equal(t, models.RunSucceeded, waitForState(t, m, active.Id).State)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Retention of the published snapshots, see expiredSnapshots. Taken from
+// SNAPSHOT_KEEP and SNAPSHOT_MAX_AGE, a max age of zero keeps snapshots
+// regardless of their age.
+var (
+	snapshotKeep   = 10
+	snapshotMaxAge = 30 * 24 * time.Hour
+)
+
+var (
+	errSnapshotNotFound   = errors.New("snapshot not found")
+	errSnapshotIncomplete = errors.New("snapshot is incomplete")
+)
+
+// listSnapshots returns every stored snapshot, the newest first.
+func listSnapshots(ctx context.Context) ([]models.Snapshot, error) {
+	manifest, err := storage.GetManifest(ctx)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	snapshotIds, err := storage.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]models.Snapshot, 0, len(snapshotIds))
+	for i := len(snapshotIds) - 1; i >= 0; i-- {
+		snapshot, err := describeSnapshot(ctx, snapshotIds[i], manifest.SnapshotId)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// describeSnapshot reads the crawl report of a snapshot. The report is the
+// last object stored before the manifest, so a snapshot without one was
+// never completely uploaded.
+func describeSnapshot(ctx context.Context, snapshotId, currentId string) (models.Snapshot, error) {
+	snapshot := models.Snapshot{Id: snapshotId, Current: snapshotId == currentId}
+	report, err := storage.GetCrawlReport(ctx, snapshotId)
+	if errors.Is(err, storage.ErrNotFound) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Complete = true
+	snapshot.Mode = report.Mode
+	snapshot.FinishedAt = report.FinishedAt
+	snapshot.AssetCount = report.AssetCount
+	return snapshot, nil
+}
+
+// expiredSnapshots returns the IDs of the snapshots, given newest first, that
+// the retention policy throws away: every complete snapshot beyond the newest
+// keep, or older than maxAge, and every incomplete one older than the current
+// snapshot. Newer incomplete snapshots may still be uploading. The current
+// snapshot is always kept, and counts towards keep.
+func expiredSnapshots(snapshots []models.Snapshot, keep int, maxAge time.Duration, now time.Time) []string {
+	var expired []string
+	kept := 0
+	pastCurrent := false
+	for _, snapshot := range snapshots {
+		switch {
+		case snapshot.Current:
+			kept++
+			pastCurrent = true
+		case !snapshot.Complete:
+			if pastCurrent {
+				expired = append(expired, snapshot.Id)
+			}
+		case kept >= keep || (maxAge > 0 && now.Sub(snapshot.FinishedAt) > maxAge):
+			expired = append(expired, snapshot.Id)
+		default:
+			kept++
+		}
+	}
+	return expired
+}
+
+// pruneSnapshots deletes the snapshots the retention policy throws away.
+func pruneSnapshots(ctx context.Context) error {
+	snapshots, err := listSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for _, snapshotId := range expiredSnapshots(snapshots, snapshotKeep, snapshotMaxAge, time.Now()) {
+		logging.Info("Deleting expired snapshot %s", snapshotId)
+		if err := storage.DeleteSnapshot(ctx, snapshotId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackSnapshot points the manifest at an earlier snapshot, which the
+// webservers then serve on their next refresh. The next crawl replaces it
+// again, incremental crawls build on it.
+func rollbackSnapshot(ctx context.Context, snapshotId string) (models.Snapshot, error) {
+	snapshotIds, err := storage.ListSnapshots(ctx)
+	if err != nil {
+		return models.Snapshot{}, err
+	}
+	if !slices.Contains(snapshotIds, snapshotId) {
+		return models.Snapshot{}, errSnapshotNotFound
+	}
+	snapshot, err := describeSnapshot(ctx, snapshotId, snapshotId)
+	if err != nil {
+		return snapshot, err
+	}
+	if !snapshot.Complete {
+		return snapshot, errSnapshotIncomplete
+	}
+
+	err = storage.PutManifest(ctx, models.Manifest{
+		SnapshotId:  snapshotId,
+		PublishedAt: time.Now().UTC(),
+		AssetCount:  int(snapshot.AssetCount),
+	})
+	if err != nil {
+		return snapshot, err
+	}
+	logging.Warning("Rolled back to snapshot %s", snapshotId)
+	return snapshot, nil
+}
+
+func handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := listSnapshots(r.Context())
+	if err != nil {
+		logging.Error("Failed to list snapshots: %v", err)
+		http.Error(w, "Failed to list snapshots", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+func handleRollbackSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshotId := chi.URLParam(r, "id")
+	snapshot, err := rollbackSnapshot(r.Context(), snapshotId)
+	switch {
+	case errors.Is(err, errSnapshotNotFound):
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+	case errors.Is(err, errSnapshotIncomplete):
+		writeJSON(w, http.StatusConflict, snapshot)
+	case err != nil:
+		logging.Error("Failed to roll back to snapshot %s: %v", snapshotId, err)
+		http.Error(w, "Failed to roll back", http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, snapshot)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiredSnapshots(t *testing.T) {
+	now := time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time { return now.Add(-time.Duration(days) * 24 * time.Hour) }
+	snapshots := []models.Snapshot{ // newest first
+		{Id: "f", Complete: false}, // may still be uploading
+		{Id: "e", Complete: true, FinishedAt: daysAgo(1)},
+		{Id: "d", Complete: true, FinishedAt: daysAgo(2), Current: true},
+		{Id: "c", Complete: false},
+		{Id: "b", Complete: true, FinishedAt: daysAgo(3)},
+		{Id: "a", Complete: true, FinishedAt: daysAgo(40)},
+	}
+
+	assert.Equal(t, []string{"c", "a"}, expiredSnapshots(snapshots, 10, 30*24*time.Hour, now))
+	assert.Equal(t, []string{"c"}, expiredSnapshots(snapshots, 10, 0, now), "no max age")
+	assert.Equal(t, []string{"c", "a"}, expiredSnapshots(snapshots, 3, 0, now))
+	assert.Equal(t, []string{"c", "b", "a"}, expiredSnapshots(snapshots, 1, 0, now),
+		"the current snapshot is kept beyond keep")
+}
+
+func TestRollbackSnapshot(t *testing.T) {
+	storage.UseDir(t.TempDir())
+	ctx := context.Background()
+	for _, snapshotId := range []string{"run-0", "run-1", "run-2"} {
+		require.NoError(t, storage.PutAssets(ctx, snapshotId, []models.Asset{{GameId: snapshotId}}))
+		require.NoError(t, storage.PutCrawlReport(ctx, snapshotId, models.CrawlReport{RunId: snapshotId, Mode: modeFull, AssetCount: 1}))
+	}
+	require.NoError(t, storage.PutManifest(ctx, models.Manifest{SnapshotId: "run-2"}))
+	require.NoError(t, storage.PutAssets(ctx, "run-3", nil)) // never finished uploading
+
+	snapshots, err := listSnapshots(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 4)
+	assert.Equal(t, models.Snapshot{Id: "run-3"}, snapshots[0])
+	assert.True(t, snapshots[1].Current)
+	assert.Equal(t, int64(1), snapshots[2].AssetCount)
+
+	_, err = rollbackSnapshot(ctx, "missing")
+	assert.ErrorIs(t, err, errSnapshotNotFound)
+	_, err = rollbackSnapshot(ctx, "run-3")
+	assert.ErrorIs(t, err, errSnapshotIncomplete)
+
+	snapshot, err := rollbackSnapshot(ctx, "run-1")
+	require.NoError(t, err)
+	assert.True(t, snapshot.Current)
+	manifest, err := storage.GetManifest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "run-1", manifest.SnapshotId)
+
+	// run-2 is newer than the current snapshot and kept, run-0 is beyond
+	// keep
+	snapshotKeep, snapshotMaxAge = 1, 0
+	defer func() { snapshotKeep, snapshotMaxAge = 10, 30*24*time.Hour }()
+	require.NoError(t, pruneSnapshots(ctx))
+	snapshotIds, err := storage.ListSnapshots(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"run-1", "run-2", "run-3"}, snapshotIds)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
+	"itchgrep/internal/thumbs"
+	"itchgrep/pkg/models"
+)
+
+// mirrorThumbs enables copying every thumbnail into our own storage, so that
+// the UI does not depend on itch.io's CDN. Taken from MIRROR_THUMBS.
+var mirrorThumbs bool
+
+// hashThumbs enables computing the perceptual hash of every thumbnail, for
+// the visual similarity search. Taken from HASH_THUMBS.
+var hashThumbs bool
+
+// paletteThumbs enables extracting the dominant colours of every thumbnail,
+// for the search by colour. Taken from PALETTE_THUMBS.
+var paletteThumbs bool
+
+// processThumbs reports whether the thumbnail stage has anything to do.
+func processThumbs() bool {
+	return mirrorThumbs || hashThumbs || paletteThumbs
+}
+
+// thumbDone reports whether asset already has everything the thumbnail stage
+// would give it.
+func thumbDone(asset models.Asset) bool {
+	return (!mirrorThumbs || asset.ThumbHash != "") &&
+		(!hashThumbs || asset.PerceptualHash != 0) &&
+		(!paletteThumbs || len(asset.Palette) > 0)
+}
+
+// previousThumbs returns the thumbnail fields of the assets of the current
+// snapshot whose thumbnails were processed, by their thumbnail URL. itch.io
+// gives a changed thumbnail a new URL, so a known URL does not have to be
+// downloaded again.
+func previousThumbs(ctx context.Context) map[string]models.Asset {
+	manifest, err := storage.GetManifest(ctx)
+	if err != nil {
+		logging.Warning("No previous snapshot, processing every thumbnail: %v", err)
+		return nil
+	}
+	byUrl := make(map[string]models.Asset)
+	err = storage.EachAsset(ctx, manifest.SnapshotId, func(asset models.Asset) error {
+		if asset.ThumbUrl != "" && thumbDone(asset) {
+			var thumb models.Asset
+			copyThumb(&thumb, asset)
+			byUrl[asset.ThumbUrl] = thumb
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Warning("No previous assets, processing every thumbnail: %v", err)
+		return nil
+	}
+	return byUrl
+}
+
+// processThumbnail downloads the thumbnail of a single asset and fills in
+// the thumbnail fields of the asset.
+func processThumbnail(ctx context.Context, asset *models.Asset) error {
+	data, err := itch.FetchFile(ctx, asset.ThumbUrl)
+	if err != nil {
+		return err
+	}
+	thumb, err := thumbs.Decode(data)
+	if err != nil {
+		return &fetcher.DecodeError{URL: asset.ThumbUrl, Err: err}
+	}
+
+	if mirrorThumbs {
+		variants, err := thumb.Variants()
+		if err != nil {
+			return &fetcher.DecodeError{URL: asset.ThumbUrl, Err: err}
+		}
+		for _, variant := range variants {
+			if err := storage.PutThumb(ctx, variant.Name, variant.ContentType, variant.Data); err != nil {
+				return err
+			}
+		}
+		asset.ThumbHash = thumb.Hash
+		asset.MirroredThumbUrl = thumbs.URL(thumb.Hash, thumbs.DefaultWidth, thumbs.FormatWebP)
+	}
+	if hashThumbs {
+		asset.PerceptualHash = thumb.DHash
+	}
+	if paletteThumbs {
+		asset.Palette = thumb.Palette
+	}
+	return nil
+}
+
+// copyThumb takes over the thumbnail fields of an earlier crawl of the same
+// thumbnail.
+func copyThumb(asset *models.Asset, previous models.Asset) {
+	asset.ThumbHash = previous.ThumbHash
+	asset.MirroredThumbUrl = previous.MirroredThumbUrl
+	asset.PerceptualHash = previous.PerceptualHash
+	asset.Palette = previous.Palette
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"itchgrep/internal/fetcher"
+	"itchgrep/internal/index"
+	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
+	"itchgrep/pkg/models"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// indexBatchSize is how many assets are added to the index at once.
+var indexBatchSize = 1500
+
+// snapshotWriter builds the files of a snapshot in a local directory while
+// the crawl is still running. Every asset it is given is added to the
+// search index in batches and appended to the assets file right away, so
+// neither has to hold the whole catalogue in memory. It also keeps what is
+// needed to decide whether to publish the snapshot. A snapshotWriter is not
+// safe for concurrent use.
+type snapshotWriter struct {
+	snapshotId string
+	dir        string // local directory of the index and the assets file
+
+	index  bleve.Index
+	batch  *bleve.Batch
+	file   *os.File
+	assets *bufio.Writer
+	closed bool
+
+	count   int
+	fill    fetcher.FillCounter
+	changes *changeTracker // nil if there is no current snapshot
+}
+
+// newSnapshotWriter creates an empty snapshot in a temporary directory. It
+// reads the current snapshot, to find out what changed since.
+func newSnapshotWriter(ctx context.Context, snapshotId string) (*snapshotWriter, error) {
+	changes, err := loadChangeTracker(ctx, snapshotId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the current snapshot: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+	w := &snapshotWriter{snapshotId: snapshotId, dir: dir, changes: changes}
+
+	w.index, err = bleve.New(filepath.Join(dir, storage.IndexDirName), index.NewMapping())
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	w.batch = w.index.NewBatch()
+
+	w.file, err = os.Create(filepath.Join(dir, storage.DataFileName))
+	if err != nil {
+		w.index.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	w.assets = bufio.NewWriter(w.file)
+	w.assets.WriteString("[")
+	logging.Info("Writing snapshot %s to %s", snapshotId, dir)
+	return w, nil
+}
+
+// write adds an asset to the snapshot. The caller makes sure that every
+// GameId is only written once.
+func (w *snapshotWriter) write(asset models.Asset) error {
+	if w.changes != nil {
+		w.changes.add(&asset)
+	}
+
+	data, err := json.Marshal(asset)
+	if err != nil {
+		return fmt.Errorf("failed to encode asset %s: %w", asset.GameId, err)
+	}
+	if w.count > 0 {
+		w.assets.WriteString(",")
+	}
+	if _, err := w.assets.Write(data); err != nil {
+		return fmt.Errorf("failed to write asset %s: %w", asset.GameId, err)
+	}
+
+	if err := w.batch.Index(asset.GameId, indexedAsset(asset)); err != nil {
+		return fmt.Errorf("failed to index asset %s: %w", asset.GameId, err)
+	}
+	if w.batch.Size() >= indexBatchSize {
+		if err := w.index.Batch(w.batch); err != nil {
+			return fmt.Errorf("failed to index batch: %w", err)
+		}
+		w.batch.Reset()
+		logging.Info("Indexed %d assets", w.count+1)
+	}
+
+	w.count++
+	w.fill.Add(asset)
+	return nil
+}
+
+// indexedAsset returns the fields of asset that are searched and filtered
+// on, which are far fewer than the stored ones.
+func indexedAsset(asset models.Asset) models.IndexedAsset {
+	return models.IndexedAsset{
+		GameId:          asset.GameId,
+		Title:           asset.Title,
+		Author:          asset.Author,
+		Description:     asset.Description,
+		Tags:            asset.Tags,
+		Facets:          asset.Facets,
+		Free:            asset.Free,
+		PriceCents:      asset.PriceCents,
+		Currency:        asset.Currency,
+		DiscountPercent: asset.DiscountPercent,
+		ColorBins:       index.ColorBins(asset.Palette),
+		InvPopularity:   asset.InvPopularity,
+	}
+}
+
+// close writes out the last batch of the index and the end of the assets
+// file. Nothing can be written afterwards.
+func (w *snapshotWriter) close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.index.Batch(w.batch)
+	if closeErr := w.index.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to finish index: %w", err)
+	}
+
+	w.assets.WriteString("]")
+	err = w.assets.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to finish assets file: %w", err)
+	}
+	logging.Info("Successfully indexed %d assets", w.count)
+	return nil
+}
+
+// discard closes the writer if needed and removes its local files, once the
+// snapshot was published or abandoned.
+func (w *snapshotWriter) discard() {
+	if err := w.close(); err != nil {
+		logging.Warning("Failed to close snapshot %s: %v", w.snapshotId, err)
+	}
+	os.RemoveAll(w.dir)
+}
+
+// publish uploads the index and the assets, together with the crawl report
+// and what changed since the current snapshot, as the snapshot of the run.
+// The snapshot is only published by pointing the manifest at it once all of
+// it is stored, so a failed upload leaves the current snapshot untouched.
+func (w *snapshotWriter) publish(ctx context.Context, report models.CrawlReport) error {
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	// STORING INDEX
+	logging.Info("Storing index in cloud storage file")
+	err := storage.PutIndex(ctx, w.snapshotId, filepath.Join(w.dir, storage.IndexDirName))
+	if err != nil {
+		return fmt.Errorf("failed to put index: %w", err)
+	}
+	logging.Info("Successfully stored index")
+
+	// STORING ASSETS
+	logging.Info("Storing assets in cloud storage file")
+	err = storage.PutAssetsFile(ctx, w.snapshotId, filepath.Join(w.dir, storage.DataFileName))
+	if err != nil {
+		return fmt.Errorf("failed to put assets: %w", err)
+	}
+	logging.Info("Successfully stored assets")
+
+	// STORING CHANGES
+	if w.changes != nil {
+		changes := w.changes.finish()
+		logging.Info("Since snapshot %s, %d assets were added, %d removed and %d edited",
+			changes.PreviousSnapshotId, len(changes.Added), len(changes.Removed), len(changes.Edited))
+		err = storage.PutChanges(ctx, w.snapshotId, changes)
+		if err != nil {
+			return fmt.Errorf("failed to put changes: %w", err)
+		}
+		logging.Info("Successfully stored changes")
+	}
+
+	// STORING REPORT
+	err = storage.PutCrawlReport(ctx, w.snapshotId, report)
+	if err != nil {
+		return fmt.Errorf("failed to put crawl report: %w", err)
+	}
+	logging.Info("Successfully stored crawl report")
+
+	// PUBLISHING SNAPSHOT
+	err = storage.PutManifest(ctx, models.Manifest{
+		SnapshotId:  w.snapshotId,
+		PublishedAt: time.Now().UTC(),
+		AssetCount:  w.count,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put manifest: %w", err)
+	}
+	logging.Info("Published snapshot %s", w.snapshotId)
+
+	// the run succeeded either way, the next one tries again
+	if err := pruneSnapshots(ctx); err != nil {
+		logging.Error("Failed to delete expired snapshots: %v", err)
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"itchgrep/internal/cache"
 	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
 	"itchgrep/internal/web"
 	"net/http"
 	"os"
@@ -28,7 +30,7 @@ func initializeCache() *cache.Cache {
 		pageSize = 36
 	}
 	c := cache.NewCache(pageSize)
-	c.RefreshDataCache()
+	c.RefreshDataCache(context.Background())
 	return c
 }
 
@@ -36,6 +38,13 @@ func main() {
 	// LOGGING
 	logging.Init("", true)
 
+	// STORAGE_DIR serves the snapshots of a local directory, such as one
+	// written by "dataservice crawl --out", instead of the bucket
+	if storageDir := os.Getenv("STORAGE_DIR"); storageDir != "" {
+		logging.Info("STORAGE_DIR: %s", storageDir)
+		storage.UseDir(storageDir)
+	}
+
 	// CACHE INIT
 	cache := initializeCache()
 
@@ -48,6 +57,9 @@ func main() {
 	r.Get("/assets/{page}", h.HandleGetAssetPage)
 	r.Post("/query/{page}", h.HandleQuery)
 	r.Get("/about", h.HandleAbout)
+	r.Get("/thumbs/{name}", h.HandleThumb)
+	r.Get("/similar", h.HandleSimilar)
+	r.Get("/new", h.HandleNew)
 
 	// SERVER
 	port := fmt.Sprintf(":%s", os.Getenv("PORT"))
@@ -1,15 +1,19 @@
 module itchgrep
 
-go 1.22.0
+go 1.22.2
 
 require (
 	cloud.google.com/go/storage v1.38.0
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/PuerkitoBio/goquery v1.9.0
 	github.com/a-h/templ v0.2.598
 	github.com/blevesearch/bleve v1.0.14
 	github.com/go-chi/chi/v5 v5.0.12
 	github.com/mholt/archiver/v4 v4.0.0-alpha.8
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/image v0.15.0
+	golang.org/x/time v0.5.0
 	google.golang.org/api v0.162.0
 )
 
@@ -73,7 +77,6 @@ require (
 	golang.org/x/sync v0.6.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	golang.org/x/time v0.5.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/genproto v0.0.0-20240125205218-1f4bbc51befe // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240205150955-31a09d347014 // indirect
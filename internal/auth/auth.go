@@ -0,0 +1,172 @@
+// Package auth verifies requests to the admin routes of the dataservice.
+// Callers either sign their request with a shared secret, see Sign, or send
+// an OIDC identity token as a bearer token, which is what Cloud Scheduler
+// does.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"itchgrep/internal/logging"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of a request signed with a shared secret.
+const (
+	SignatureHeader = "X-Itchgrep-Signature" // hex encoded, see Sign
+	TimestampHeader = "X-Itchgrep-Timestamp" // unix seconds
+)
+
+// maxSkew is how far the timestamp of a signed request may be from the
+// current time, which limits how long a captured request can be replayed.
+const maxSkew = 5 * time.Minute
+
+// maxBodySize is the largest body that is read to check a signature.
+const maxBodySize = 1 << 20
+
+// ErrUnauthorized is returned for requests without valid credentials.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Config configures a Verifier. Every method whose settings are empty is
+// disabled.
+type Config struct {
+	HMACSecret []byte
+
+	// OIDC tokens are accepted if they are signed by a key of Keys, are
+	// meant for Audience and were issued by Issuer to one of Emails. Issuer
+	// defaults to the one of a well known Keys URL, see KeySet.Issuer.
+	Keys     *KeySet
+	Audience string
+	Issuer   string
+	Emails   []string
+
+	// AllowUnauthenticated lets every request through, for local
+	// development.
+	AllowUnauthenticated bool
+}
+
+// Verifier checks the credentials of requests.
+type Verifier struct {
+	cfg Config
+	now func() time.Time
+}
+
+// NewVerifier creates a verifier for cfg. A verifier without any method
+// enabled rejects every request, so that a missing setting does not open
+// up the admin routes. For the same reason, OIDC tokens are only accepted
+// from a known issuer and to listed emails, since anyone with an account at
+// a provider like Google can get a token for any audience.
+func NewVerifier(cfg Config) (*Verifier, error) {
+	if cfg.Keys != nil {
+		if cfg.Issuer == "" {
+			cfg.Issuer = cfg.Keys.Issuer()
+		}
+		switch {
+		case cfg.Audience == "":
+			return nil, errors.New("an audience is required to verify OIDC tokens")
+		case cfg.Issuer == "":
+			return nil, fmt.Errorf("an issuer is required to verify OIDC tokens signed by %s", cfg.Keys.source)
+		case len(cfg.Emails) == 0:
+			return nil, errors.New("allowed emails are required to verify OIDC tokens")
+		}
+	}
+	return &Verifier{cfg: cfg, now: time.Now}, nil
+}
+
+// Enabled reports whether any request can pass the verifier.
+func (v *Verifier) Enabled() bool {
+	return v.cfg.AllowUnauthenticated || len(v.cfg.HMACSecret) > 0 || v.cfg.Keys != nil
+}
+
+// Verify checks the credentials of r. A signed request has its body read and
+// replaced, so that handlers can still read it.
+func (v *Verifier) Verify(r *http.Request) error {
+	if v.cfg.AllowUnauthenticated {
+		return nil
+	}
+	if r.Header.Get(SignatureHeader) != "" && len(v.cfg.HMACSecret) > 0 {
+		return v.verifySignature(r)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && v.cfg.Keys != nil {
+		return v.verifyToken(r, token)
+	}
+	return fmt.Errorf("%w: no supported credentials", ErrUnauthorized)
+}
+
+// Middleware rejects every request that does not pass Verify.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			logging.Warning("Rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Sign returns the signature of a request for SignatureHeader: the hex
+// encoded HMAC-SHA256 of the timestamp, method, request URI and body, each
+// on a line of its own. The request URI includes the query, so that a
+// signed full crawl can not be turned into something else.
+func Sign(secret []byte, timestamp int64, method, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, requestURI)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the signature headers of r, whose body is read and
+// replaced.
+func SignRequest(r *http.Request, secret []byte, now time.Time) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := now.Unix()
+	r.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(SignatureHeader, Sign(secret, timestamp, r.Method, r.URL.RequestURI(), body))
+	return nil
+}
+
+func (v *Verifier) verifySignature(r *http.Request) error {
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp", ErrUnauthorized)
+	}
+	if skew := v.now().Sub(time.Unix(timestamp, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w: timestamp is %v off", ErrUnauthorized, skew)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return fmt.Errorf("%w: failed to read body: %v", ErrUnauthorized, err)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected, err := hex.DecodeString(Sign(v.cfg.HMACSecret, timestamp, r.Method, r.URL.RequestURI(), body))
+	if err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil || !hmac.Equal(signature, expected) {
+		return fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestVerifier(t *testing.T, cfg Config) *Verifier {
+	v, err := NewVerifier(cfg)
+	require.NoError(t, err)
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("s3cret")
+	v := newTestVerifier(t, Config{HMACSecret: secret})
+
+	signed := func(target, body string, at time.Time, secret []byte) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		require.NoError(t, SignRequest(r, secret, at))
+		return r
+	}
+
+	r := signed("/trigger-fetch?mode=full", "", testNow, secret)
+	assert.NoError(t, v.Verify(r))
+
+	r = signed("/trigger-fetch", "payload", testNow.Add(-time.Minute), secret)
+	require.NoError(t, v.Verify(r))
+	body := make([]byte, 7)
+	_, err := r.Body.Read(body)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(body), "the body should still be readable")
+
+	assert.ErrorIs(t, v.Verify(signed("/trigger-fetch", "", testNow, []byte("wrong"))), ErrUnauthorized)
+	assert.ErrorIs(t, v.Verify(signed("/trigger-fetch", "", testNow.Add(-time.Hour), secret)), ErrUnauthorized)
+
+	// the query is part of the signature
+	r = signed("/trigger-fetch?mode=incremental", "", testNow, secret)
+	r.URL.RawQuery = "mode=full"
+	assert.ErrorIs(t, v.Verify(r), ErrUnauthorized)
+
+	assert.ErrorIs(t, v.Verify(httptest.NewRequest(http.MethodPost, "/trigger-fetch", nil)), ErrUnauthorized)
+}
+
+// writeJWKS stores the public part of key as a JWKS file.
+func writeJWKS(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	doc := map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keys, err := NewKeySet(context.Background(), writeJWKS(t, "key-1", key))
+	require.NoError(t, err)
+
+	v := newTestVerifier(t, Config{
+		Keys:     keys,
+		Audience: "https://dataservice.example",
+		Issuer:   "https://accounts.google.com",
+		Emails:   []string{"scheduler@example.iam.gserviceaccount.com"},
+	})
+	validClaims := func() map[string]any {
+		return map[string]any{
+			"iss":   "https://accounts.google.com",
+			"aud":   "https://dataservice.example",
+			"email": "scheduler@example.iam.gserviceaccount.com",
+			"iat":   testNow.Unix(),
+			"exp":   testNow.Add(time.Hour).Unix(),
+		}
+	}
+	header := map[string]any{"alg": "RS256", "kid": "key-1", "typ": "JWT"}
+	verify := func(token string) error {
+		r := httptest.NewRequest(http.MethodPost, "/trigger-fetch", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return v.Verify(r)
+	}
+
+	assert.NoError(t, verify(signToken(t, key, header, validClaims())))
+
+	claims := validClaims()
+	claims["aud"] = []string{"other", "https://dataservice.example"}
+	assert.NoError(t, verify(signToken(t, key, header, claims)))
+
+	claims = validClaims()
+	claims["aud"] = "https://other.example"
+	assert.ErrorIs(t, verify(signToken(t, key, header, claims)), ErrUnauthorized)
+
+	claims = validClaims()
+	claims["exp"] = testNow.Add(-time.Hour).Unix()
+	assert.ErrorIs(t, verify(signToken(t, key, header, claims)), ErrUnauthorized)
+
+	claims = validClaims()
+	claims["email"] = "someone@example.com"
+	assert.ErrorIs(t, verify(signToken(t, key, header, claims)), ErrUnauthorized)
+
+	assert.ErrorIs(t, verify(signToken(t, otherKey, header, validClaims())), ErrUnauthorized)
+	assert.ErrorIs(t, verify(signToken(t, key, map[string]any{"alg": "RS256", "kid": "key-2"}, validClaims())), ErrUnauthorized)
+	assert.ErrorIs(t, verify(signToken(t, key, map[string]any{"alg": "HS256", "kid": "key-1"}, validClaims())), ErrUnauthorized)
+	assert.ErrorIs(t, verify("not.a.token"), ErrUnauthorized)
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := func(v *Verifier) http.Handler {
+		return v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+
+	// without any method configured, everything is rejected
+	v := newTestVerifier(t, Config{})
+	assert.False(t, v.Enabled())
+	w := httptest.NewRecorder()
+	handler(v).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trigger-fetch", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	v = newTestVerifier(t, Config{AllowUnauthenticated: true})
+	w = httptest.NewRecorder()
+	handler(v).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trigger-fetch", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	_, err := NewVerifier(Config{Keys: &KeySet{}})
+	assert.Error(t, err, "tokens can not be checked without an audience")
+}
+
+func TestNewVerifierOIDC(t *testing.T) {
+	google := &KeySet{source: "https://www.googleapis.com/oauth2/v3/certs"}
+	emails := []string{"scheduler@example.iam.gserviceaccount.com"}
+
+	v, err := NewVerifier(Config{Keys: google, Audience: "https://dataservice.example", Emails: emails})
+	require.NoError(t, err)
+	assert.Equal(t, "https://accounts.google.com", v.cfg.Issuer, "the issuer of a well known provider is the default")
+
+	_, err = NewVerifier(Config{Keys: google, Audience: "https://dataservice.example"})
+	assert.Error(t, err, "without allowed emails, every account of the provider would pass")
+
+	other := &KeySet{source: "https://idp.example/jwks"}
+	_, err = NewVerifier(Config{Keys: other, Audience: "https://dataservice.example", Emails: emails})
+	assert.Error(t, err, "the issuer of other providers must be given")
+	_, err = NewVerifier(Config{Keys: other, Audience: "https://dataservice.example", Issuer: "https://idp.example", Emails: emails})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leeway is the clock difference tolerated when checking the lifetime of a
+// token.
+const leeway = time.Minute
+
+// Providers rotate their keys, so keys read from a URL are refetched
+// regularly, and early when a token names an unknown key, but no more often
+// than minRefreshInterval.
+const (
+	refreshInterval    = time.Hour
+	minRefreshInterval = time.Minute
+)
+
+// KeySet holds the public keys of an OIDC provider, as published in its JWKS
+// document. Only RSA keys are supported, which is what Google signs its
+// identity tokens with.
+type KeySet struct {
+	source string // a file or an http(s) URL
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey // by key ID
+	fetchedAt time.Time
+}
+
+// NewKeySet reads the JWKS document at source, which is either a local file
+// or an http(s) URL such as https://www.googleapis.com/oauth2/v3/certs.
+func NewKeySet(ctx context.Context, source string) (*KeySet, error) {
+	s := &KeySet{source: source, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// knownIssuers are the issuers of the tokens signed by the keys at well known
+// JWKS URLs.
+var knownIssuers = map[string]string{
+	"https://www.googleapis.com/oauth2/v3/certs": "https://accounts.google.com",
+	"https://www.googleapis.com/oauth2/v1/certs": "https://accounts.google.com",
+}
+
+// Issuer returns the issuer of the tokens signed by the keys of the set if
+// its source is a well known URL, or "" otherwise.
+func (s *KeySet) Issuer() string {
+	return knownIssuers[s.source]
+}
+
+func (s *KeySet) isURL() bool {
+	return strings.HasPrefix(s.source, "https://") || strings.HasPrefix(s.source, "http://")
+}
+
+// refresh reads the keys from the source again. The caller must not hold
+// s.mu.
+func (s *KeySet) refresh(ctx context.Context) error {
+	var data []byte
+	var err error
+	if s.isURL() {
+		data, err = s.fetch(ctx)
+	} else {
+		data, err = os.ReadFile(s.source)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS from %s: %w", s.source, err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse JWKS from %s: %w", s.source, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
+
+func (s *KeySet) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+}
+
+// key returns the key with the given ID. Tokens without a key ID are
+// accepted if the set has a single key.
+func (s *KeySet) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	key := s.lookup(kid)
+	stale := s.isURL() && (time.Since(s.fetchedAt) > refreshInterval ||
+		(key == nil && time.Since(s.fetchedAt) > minRefreshInterval))
+	s.mu.Unlock()
+
+	if stale {
+		if err := s.refresh(ctx); err != nil {
+			if key == nil {
+				return nil, err
+			}
+			// keep using the keys we have until the provider is back
+		} else {
+			s.mu.Lock()
+			key = s.lookup(kid)
+			s.mu.Unlock()
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// lookup returns the key with the given ID, the caller must hold s.mu.
+func (s *KeySet) lookup(kid string) *rsa.PublicKey {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key
+		}
+	}
+	return s.keys[kid]
+}
+
+// jwk is a single key of a JWKS document, see RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid modulus: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid exponent: %w", k.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %q: unsupported exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA signing keys")
+	}
+	return keys, nil
+}
+
+// claims are the claims of an identity token that are checked.
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	Email     string   `json:"email"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+// audience is the aud claim, which is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// verifyToken checks the signature and claims of an RS256 signed JWT.
+func (v *Verifier) verifyToken(r *http.Request, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", ErrUnauthorized)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("%w: malformed token header: %v", ErrUnauthorized, err)
+	}
+	// the algorithm is fixed, so that a token can not pick a weaker one
+	if header.Alg != "RS256" {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrUnauthorized, header.Alg)
+	}
+
+	key, err := v.cfg.Keys.key(r.Context(), header.Kid)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrUnauthorized)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return fmt.Errorf("%w: malformed claims: %v", ErrUnauthorized, err)
+	}
+	now := v.now()
+	switch {
+	case c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(leeway)):
+		return fmt.Errorf("%w: token expired", ErrUnauthorized)
+	case c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)):
+		return fmt.Errorf("%w: token not valid yet", ErrUnauthorized)
+	case !slices.Contains(c.Audience, v.cfg.Audience):
+		return fmt.Errorf("%w: token is for %v", ErrUnauthorized, c.Audience)
+	case c.Issuer != v.cfg.Issuer:
+		return fmt.Errorf("%w: token issued by %s", ErrUnauthorized, c.Issuer)
+	case !slices.Contains(v.cfg.Emails, c.Email):
+		return fmt.Errorf("%w: token issued to %q", ErrUnauthorized, c.Email)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
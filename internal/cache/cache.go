@@ -1,10 +1,14 @@
 package cache
 
 import (
+	"context"
 	"errors"
+	"itchgrep/internal/index"
 	"itchgrep/internal/logging"
 	"itchgrep/internal/storage"
+	"itchgrep/internal/thumbs"
 	"itchgrep/pkg/models"
+	"os"
 	"slices"
 	"sync"
 	"time"
@@ -19,11 +23,13 @@ type Cache struct {
 	dataMap map[string]models.Asset
 	data    []models.Asset
 	index   bleve.Index
+	facets  []string        // every facet any asset has, sorted
+	changes *models.Changes // since the previous snapshot, nil if unknown
 
-	// the time the data was last updated on the server.
-	// if we check if the current time is greater than this time, we know the
-	// cache is expired
-	dataUpdatedTime time.Time
+	// the snapshot the data and index belong to. if the manifest on the
+	// server names another one, the cache is expired
+	snapshotId string
+	indexDir   string // the local copy of the index, removed when replaced
 
 	// the cache can be retrieved as chunks/pages
 	pageSize int64
@@ -31,10 +37,9 @@ type Cache struct {
 
 func NewCache(pageSize int64) *Cache {
 	return &Cache{
-		dataMap:         make(map[string]models.Asset),
-		cacheLock:       sync.RWMutex{},
-		pageSize:        pageSize,
-		dataUpdatedTime: time.Time{},
+		dataMap:   make(map[string]models.Asset),
+		cacheLock: sync.RWMutex{},
+		pageSize:  pageSize,
 	}
 }
 
@@ -43,69 +48,99 @@ func (c *Cache) IsCacheExpired() bool {
 	defer c.cacheLock.RUnlock()
 
 	// if we never updated the cache, it is expired
-	if c.dataUpdatedTime.IsZero() {
+	if c.snapshotId == "" {
 		return true
 	}
 
-	// otherwise, we check if the data on the server is newer than the data in the cache
-	storageUpdateTime, err := storage.GetAssetsUpdateTime()
+	// otherwise, we check if the server publishes another snapshot by now
+	manifest, err := storage.GetManifest(context.Background())
 	if err != nil {
-		logging.Error("Failed to get assets update time: %v", err)
+		logging.Error("Failed to get manifest: %v", err)
 		return false
 	}
-	return c.dataUpdatedTime.Before(storageUpdateTime)
+	return manifest.SnapshotId != c.snapshotId
 }
 
-func (c *Cache) RefreshDataCache() error {
-	c.cacheLock.Lock()
-	defer c.cacheLock.Unlock()
-
-	// we fetch this here already, since we can just stop if we fail to fetch even this
-	newServerUpdateTime, err := storage.GetAssetsUpdateTime()
+// RefreshDataCache loads the snapshot named in the manifest. Everything is
+// read from that snapshot, so the data and the index always match, and the
+// cache keeps serving the old snapshot until the new one is fully loaded.
+func (c *Cache) RefreshDataCache(ctx context.Context) error {
+	// we fetch this first, since we can just stop if we fail to fetch even this
+	manifest, err := storage.GetManifest(ctx)
 	if err != nil {
 		return err
 	}
 
 	// fetch asset data
 	preFetchTime := time.Now()
-	newData, err := storage.GetAssets()
+	newData, err := storage.GetAssets(ctx, manifest.SnapshotId)
 	if err != nil || newData == nil {
 		return err
 	}
 	fetchTime := time.Since(preFetchTime)
-	logging.Info("Fetched %d assets in %v", len(newData), fetchTime)
+	logging.Info("Fetched %d assets of snapshot %s in %v", len(newData), manifest.SnapshotId, fetchTime)
 
-	// TODO: this whole procedure is pretty unsafe. we should not close the
-	// index before we are sure we have a new one to replace it with.
-	// But most likely we need to close the old index before we can open a new one at the same path.
-	// We should probably use a temporary path for the new index and then move it to the correct path.
-
-	// fetch index data
+	// fetch index data. every snapshot is extracted to a directory of its
+	// own, so the old index stays open until the new one replaces it
 	preFetchTime = time.Now()
-	if c.index != nil {
-		c.index.Close()
+	indexDir, err := os.MkdirTemp("", "index-"+manifest.SnapshotId+"-")
+	if err != nil {
+		return err
+	}
+	indexPath, err := storage.GetIndex(ctx, manifest.SnapshotId, indexDir)
+	if err != nil {
+		os.RemoveAll(indexDir)
+		return err
 	}
-	indexPath, err := storage.GetFS(storage.IndexArchiveName, ".")
-	c.index, err = bleve.Open(indexPath)
+	newIndex, err := bleve.Open(indexPath)
 	if err != nil {
+		os.RemoveAll(indexDir)
 		return err
 	}
 
 	fetchTime = time.Since(preFetchTime)
 	logging.Info("Fetched and opened index in %v", fetchTime)
 
+	// the changes are only shown, a snapshot without them is still served
+	var newChanges *models.Changes
+	changes, err := storage.GetChanges(ctx, manifest.SnapshotId)
+	switch {
+	case err == nil:
+		newChanges = &changes
+	case !errors.Is(err, storage.ErrNotFound):
+		logging.Error("Failed to fetch changes of snapshot %s: %v", manifest.SnapshotId, err)
+	}
+
 	// sort newData by popularity (smaller numbers first)
 	slices.SortFunc(newData, func(i, j models.Asset) int {
 		return int(i.InvPopularity - j.InvPopularity)
 	})
 
 	// overwrite the old data with the new data
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if c.index != nil {
+		c.index.Close()
+		os.RemoveAll(c.indexDir)
+	}
+	c.index = newIndex
+	c.indexDir = indexDir
+	c.changes = newChanges
 	c.data = newData
 	c.dataMap = make(map[string]models.Asset, len(newData)) // we also save it as a map, so we can easily match searches from the index
+	facets := make(map[string]bool)
 	for _, asset := range newData {
 		c.dataMap[asset.GameId] = asset
+		for _, facet := range asset.Facets {
+			facets[facet] = true
+		}
+	}
+	c.facets = make([]string, 0, len(facets))
+	for facet := range facets {
+		c.facets = append(c.facets, facet)
 	}
-	c.dataUpdatedTime = newServerUpdateTime
+	slices.Sort(c.facets)
+	c.snapshotId = manifest.SnapshotId
 	return nil
 }
 
@@ -125,9 +160,14 @@ func buildFuzzyQuery(queryString string, fuzzyness int, prefixLen int) *query.Di
 	authorQuery.SetBoost(1)
 	authorQuery.SetPrefix(prefixLen)
 	authorQuery.SetFuzziness(fuzzyness)
+	tagsQuery := bleve.NewMatchQuery(queryString)
+	tagsQuery.SetField("Tags")
+	tagsQuery.SetBoost(2)
+	tagsQuery.SetPrefix(prefixLen)
+	tagsQuery.SetFuzziness(fuzzyness)
 
 	// Combine queries with a disjunction (OR) query
-	query := bleve.NewDisjunctionQuery(titleQuery, descriptionQuery, authorQuery)
+	query := bleve.NewDisjunctionQuery(titleQuery, descriptionQuery, authorQuery, tagsQuery)
 	return query
 }
 
@@ -141,16 +181,87 @@ func buildExactQuery(queryString string) *query.DisjunctionQuery {
 	authorQuery := bleve.NewMatchQuery(queryString)
 	authorQuery.SetField("Author")
 	authorQuery.SetBoost(1)
+	tagsQuery := bleve.NewMatchQuery(queryString)
+	tagsQuery.SetField("Tags")
+	tagsQuery.SetBoost(2)
 
 	// Combine queries with a disjunction (OR) query
-	query := bleve.NewDisjunctionQuery(titleQuery, descriptionQuery, authorQuery)
+	query := bleve.NewDisjunctionQuery(titleQuery, descriptionQuery, authorQuery, tagsQuery)
 	return query
 }
 
-func (c *Cache) QueryCache(queryString string, pageIndex int64) ([]models.Asset, error) {
+// Filters narrow down the results of a query. Every filter that is set must
+// match.
+type Filters struct {
+	Facets []string // itch.io listing facets, e.g. "free"
+
+	Free          bool
+	OnSale        bool
+	MaxPriceCents int64 // zero means any price, prices in other currencies are compared as if they were the same
+
+	// Color restricts the results to assets with a dominant colour near it,
+	// the nearest first. Its Share is ignored.
+	Color *models.Color
+}
+
+// IsEmpty reports whether no filter is set.
+func (f Filters) IsEmpty() bool {
+	return len(f.Facets) == 0 && !f.Free && !f.OnSale && f.MaxPriceCents == 0 && f.Color == nil
+}
+
+func (f Filters) queries() []query.Query {
+	var queries []query.Query
+	for _, facet := range f.Facets {
+		facetQuery := bleve.NewTermQuery(facet)
+		facetQuery.SetField(index.FieldFacets)
+		queries = append(queries, facetQuery)
+	}
+	if f.Free {
+		freeQuery := bleve.NewBoolFieldQuery(true)
+		freeQuery.SetField(index.FieldFree)
+		queries = append(queries, freeQuery)
+	}
+	if f.OnSale {
+		minDiscount := 1.0
+		saleQuery := bleve.NewNumericRangeQuery(&minDiscount, nil)
+		saleQuery.SetField(index.FieldDiscountPercent)
+		queries = append(queries, saleQuery)
+	}
+	if f.MaxPriceCents > 0 {
+		maxPrice, inclusive := float64(f.MaxPriceCents), true
+		priceQuery := bleve.NewNumericRangeInclusiveQuery(nil, &maxPrice, nil, &inclusive)
+		priceQuery.SetField(index.FieldPriceCents)
+		queries = append(queries, priceQuery)
+	}
+	if f.Color != nil {
+		// nearer bins score higher, which ranks the results by distance
+		var binQueries []query.Query
+		for bin, distance := range index.NearColorBins(*f.Color) {
+			binQuery := bleve.NewTermQuery(bin)
+			binQuery.SetField(index.FieldColorBins)
+			binQuery.SetBoost(float64(4 - distance))
+			binQueries = append(binQueries, binQuery)
+		}
+		queries = append(queries, bleve.NewDisjunctionQuery(binQueries...))
+	}
+	return queries
+}
+
+// Facets returns every facet that can be filtered by.
+func (c *Cache) Facets() []string {
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+	return c.facets
+}
+
+// QueryCache searches the assets for queryString, restricted by filters. An
+// empty queryString matches every asset that passes the filters.
+func (c *Cache) QueryCache(queryString string, filters Filters, pageIndex int64) ([]models.Asset, error) {
 	// check for stale cache, refresh if needed
 	if c.IsCacheExpired() {
-		if err := c.RefreshDataCache(); err != nil {
+		// the refresh is shared by every caller, so it must not be aborted
+		// just because the request that triggered it went away.
+		if err := c.RefreshDataCache(context.Background()); err != nil {
 			return nil, err
 		}
 	}
@@ -158,16 +269,23 @@ func (c *Cache) QueryCache(queryString string, pageIndex int64) ([]models.Asset,
 	c.cacheLock.RLock()
 	defer c.cacheLock.RUnlock()
 
-	veryFuzzyQuery := buildFuzzyQuery(queryString, 1, 2)
-	veryFuzzyQuery.SetBoost(2)
-	fuzzyQuery := buildFuzzyQuery(queryString, 1, 4)
-	fuzzyQuery.SetBoost(4)
-	exactQuery := buildExactQuery(queryString)
-	exactQuery.SetBoost(6)
-	query := bleve.NewDisjunctionQuery(veryFuzzyQuery, fuzzyQuery, exactQuery)
+	var textQuery query.Query = bleve.NewMatchAllQuery()
+	if queryString != "" {
+		veryFuzzyQuery := buildFuzzyQuery(queryString, 1, 2)
+		veryFuzzyQuery.SetBoost(2)
+		fuzzyQuery := buildFuzzyQuery(queryString, 1, 4)
+		fuzzyQuery.SetBoost(4)
+		exactQuery := buildExactQuery(queryString)
+		exactQuery.SetBoost(6)
+		textQuery = bleve.NewDisjunctionQuery(veryFuzzyQuery, fuzzyQuery, exactQuery)
+	}
+	searchQuery := textQuery
+	if !filters.IsEmpty() {
+		searchQuery = bleve.NewConjunctionQuery(append([]query.Query{textQuery}, filters.queries()...)...)
+	}
 
 	from := (int(pageIndex) - 1) * int(c.pageSize)
-	searchRequest := bleve.NewSearchRequestOptions(query, int(c.pageSize), from, false)
+	searchRequest := bleve.NewSearchRequestOptions(searchQuery, int(c.pageSize), from, false)
 
 	//searchRequest.Highlight = bleve.NewHighlight()
 	searchRequest.Fields = []string{"Title", "Author", "Description"}
@@ -178,7 +296,7 @@ func (c *Cache) QueryCache(queryString string, pageIndex int64) ([]models.Asset,
 		return nil, err
 	}
 
-	logging.Info("Got %d hits for query \"%s\"", searchResult.Total, queryString)
+	logging.Info("Got %d hits for query \"%s\" with filters %+v", searchResult.Total, queryString, filters)
 
 	var matchedAssets []models.Asset
 	for _, hit := range searchResult.Hits {
@@ -188,6 +306,94 @@ func (c *Cache) QueryCache(queryString string, pageIndex int64) ([]models.Asset,
 	return matchedAssets, nil
 }
 
+// maxSimilarDistance is the largest difference between the perceptual hashes
+// of two thumbnails that still counts as looking similar.
+const maxSimilarDistance = 16
+
+// NewAssets returns up to limit assets that first appeared in a snapshot
+// after since, the newest first.
+func (c *Cache) NewAssets(since time.Time, limit int) ([]models.Asset, error) {
+	if c.IsCacheExpired() {
+		if err := c.RefreshDataCache(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+
+	var assets []models.Asset
+	for _, asset := range c.data {
+		if asset.FirstSeenAt != nil && asset.FirstSeenAt.After(since) {
+			assets = append(assets, asset)
+		}
+	}
+	// the data is sorted by popularity, which the stable sort keeps among
+	// the assets of the same snapshot
+	slices.SortStableFunc(assets, func(a, b models.Asset) int {
+		return b.FirstSeenAt.Compare(*a.FirstSeenAt)
+	})
+	if len(assets) > limit {
+		assets = assets[:limit]
+	}
+	return assets, nil
+}
+
+// Changes returns what changed in the current snapshot since the previous
+// one, or nil if that is unknown.
+func (c *Cache) Changes() *models.Changes {
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+	return c.changes
+}
+
+// Similar returns up to limit assets whose thumbnails look like the one of
+// the asset with the given GameId, the most similar first. Assets without a
+// perceptual hash are never similar to anything.
+func (c *Cache) Similar(gameId string, limit int) ([]models.Asset, error) {
+	if c.IsCacheExpired() {
+		if err := c.RefreshDataCache(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+
+	asset, ok := c.dataMap[gameId]
+	if !ok {
+		return nil, errors.New("Asset not found")
+	}
+	if asset.PerceptualHash == 0 {
+		return nil, nil
+	}
+
+	// a linear scan is fast enough for a few hundred thousand hashes
+	type neighbour struct {
+		asset    models.Asset
+		distance int
+	}
+	var neighbours []neighbour
+	for _, other := range c.data {
+		if other.PerceptualHash == 0 || other.GameId == gameId {
+			continue
+		}
+		if distance := thumbs.Distance(asset.PerceptualHash, other.PerceptualHash); distance <= maxSimilarDistance {
+			neighbours = append(neighbours, neighbour{asset: other, distance: distance})
+		}
+	}
+	// c.data is sorted by popularity, which the stable sort keeps for ties
+	slices.SortStableFunc(neighbours, func(a, b neighbour) int {
+		return a.distance - b.distance
+	})
+
+	similar := make([]models.Asset, 0, min(limit, len(neighbours)))
+	for _, n := range neighbours[:min(limit, len(neighbours))] {
+		similar = append(similar, n.asset)
+	}
+	return similar, nil
+}
+
 func (c *Cache) Page(pageNum int64) ([]models.Asset, error) {
 
 	// TODO: maybe we dont even have to check for a stale cache, since most
@@ -195,7 +401,7 @@ func (c *Cache) Page(pageNum int64) ([]models.Asset, error) {
 
 	// check for stale cache, refresh if needed
 	if c.IsCacheExpired() {
-		if err := c.RefreshDataCache(); err != nil {
+		if err := c.RefreshDataCache(context.Background()); err != nil {
 			return nil, err
 		}
 	}
@@ -0,0 +1,147 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"itchgrep/internal/logging"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// A cassette is a directory of recorded responses, one JSON file per request.
+// Recording a crawl once and replaying it later makes the whole pipeline
+// reproducible without any network access.
+
+// cassetteEntry is a single recorded response.
+type cassetteEntry struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// cassetteFile returns the path of the recording of a request in dir.
+func cassetteFile(dir string, req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// RecordingTransport passes every request on to Transport and saves the
+// response to the cassette in Dir. Responses that the fetcher would retry
+// are not saved, so a cassette only holds the answers a crawl ended up with.
+type RecordingTransport struct {
+	Dir       string
+	Transport http.RoundTripper // nil means http.DefaultTransport
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil || isRetryableStatus(resp.StatusCode) {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry := cassetteEntry{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}
+	if err := writeCassetteEntry(cassetteFile(t.Dir, req), entry); err != nil {
+		logging.Warning("Failed to record response of %s: %v", entry.URL, err)
+	}
+	return resp, nil
+}
+
+func writeCassetteEntry(path string, entry cassetteEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file of its own first, so concurrent workers
+	// never see a half written recording, even of the same request
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReplayTransport answers requests from the cassette in Dir instead of the
+// network. Requests that were never recorded get a 404 Not Found, which the
+// fetcher does not retry.
+type ReplayTransport struct {
+	Dir string
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	data, err := os.ReadFile(cassetteFile(t.Dir, req))
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Warning("No recording of %s %s in %s", req.Method, req.URL, t.Dir)
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry cassetteEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("corrupt recording of %s: %w", req.URL, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header,
+		Body:          io.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}, nil
+}
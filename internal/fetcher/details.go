@@ -0,0 +1,158 @@
+package fetcher
+
+import (
+	"context"
+	"io"
+	"itchgrep/pkg/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// itch.io shows dates as e.g. "15 February 2024 @ 10:16 UTC" in the title of
+// the abbreviations in the info panel.
+const detailDateLayout = "2 January 2006 @ 15:04 MST"
+
+// AssetDetails holds everything an asset page tells us beyond the listing.
+type AssetDetails struct {
+	Tags            []string
+	Price           *ListingPrice // nil if the page shows none, e.g. for free assets
+	License         string
+	Files           []models.AssetFile
+	Rating          float64
+	RatingCount     int64
+	PublishedAt     *time.Time
+	UpdatedAt       *time.Time
+	FullDescription string
+}
+
+// Apply copies the details onto asset.
+func (d AssetDetails) Apply(asset *models.Asset) {
+	asset.Tags = d.Tags
+	if d.Price != nil {
+		// the page is more recent than the listing, but has no sale badge
+		asset.Free = d.Price.Free
+		asset.PriceCents = d.Price.Cents
+		asset.Currency = d.Price.Currency
+	}
+	asset.License = d.License
+	asset.Files = d.Files
+	asset.Rating = d.Rating
+	asset.RatingCount = d.RatingCount
+	asset.PublishedAt = d.PublishedAt
+	asset.UpdatedAt = d.UpdatedAt
+	asset.FullDescription = d.FullDescription
+}
+
+// FetchAssetDetails fetches the page of a single asset, as linked from the
+// listing, and parses its details.
+func (f *Fetcher) FetchAssetDetails(ctx context.Context, link string) (AssetDetails, error) {
+	resp, err := f.do(ctx, link)
+	if err != nil {
+		return AssetDetails{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return AssetDetails{}, &StatusError{URL: link, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return ParseAssetDetails(resp.Body)
+}
+
+// ParseAssetDetails reads the details of an asset from the HTML of its page.
+func ParseAssetDetails(r io.Reader) (AssetDetails, error) {
+	queryDoc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return AssetDetails{}, &ParseError{What: "asset details", Err: err}
+	}
+
+	var details AssetDetails
+	details.FullDescription = strings.TrimSpace(queryDoc.Find(".formatted_description").First().Text())
+
+	// the price is only shown for assets that are not free
+	priceText := strings.TrimSpace(queryDoc.Find(".buy_row .dollars").First().Text())
+	if amount, ok := queryDoc.Find("[itemprop=price]").First().Attr("content"); ok {
+		currency, _ := queryDoc.Find("[itemprop=priceCurrency]").First().Attr("content")
+		priceText = currency + " " + amount
+	}
+	if price, err := parsePriceText(priceText); err == nil {
+		details.Price = &price
+	}
+
+	// the info panel is a table of "label | value" rows
+	queryDoc.Find(".game_info_panel_widget tr").Each(func(i int, row *goquery.Selection) {
+		cells := row.Find("td")
+		if cells.Length() < 2 {
+			return
+		}
+		label := strings.ToLower(strings.TrimSpace(cells.First().Text()))
+		value := cells.Eq(1)
+		switch label {
+		case "published", "release date":
+			details.PublishedAt = parseDetailDate(value)
+		case "updated":
+			details.UpdatedAt = parseDetailDate(value)
+		case "tags":
+			value.Find("a").Each(func(i int, tag *goquery.Selection) {
+				if name := strings.TrimSpace(tag.Text()); name != "" {
+					details.Tags = append(details.Tags, name)
+				}
+			})
+		case "license", "asset license":
+			details.License = strings.TrimSpace(value.Text())
+		case "rating":
+			if rating, ok := value.Find("[itemprop=ratingValue]").Attr("content"); ok {
+				details.Rating, _ = strconv.ParseFloat(rating, 64)
+			}
+			if count, ok := value.Find("[itemprop=ratingCount]").Attr("content"); ok {
+				details.RatingCount, _ = strconv.ParseInt(count, 10, 64)
+			}
+		}
+	})
+
+	queryDoc.Find(".upload_list_widget .upload").Each(func(i int, upload *goquery.Selection) {
+		name := strings.TrimSpace(upload.Find(".upload_name .name").Text())
+		if name == "" {
+			return
+		}
+		details.Files = append(details.Files, models.AssetFile{
+			Name: name,
+			Size: strings.TrimSpace(upload.Find(".file_size span").First().Text()),
+		})
+	})
+
+	return details, nil
+}
+
+// parseDetailDate reads a date from the info panel, which is stored in the
+// title of an abbreviation. It returns nil if there is none.
+func parseDetailDate(s *goquery.Selection) *time.Time {
+	title, ok := s.Find("abbr").Attr("title")
+	if !ok {
+		return nil
+	}
+	date, err := time.Parse(detailDateLayout, strings.TrimSpace(title))
+	if err != nil {
+		return nil
+	}
+	date = date.UTC()
+	return &date
+}
+
+// AssetDetailsOf returns the details already stored on asset. The price is
+// left out, since the listing asset came from is at least as recent.
+func AssetDetailsOf(asset models.Asset) AssetDetails {
+	return AssetDetails{
+		Tags:            asset.Tags,
+		License:         asset.License,
+		Files:           asset.Files,
+		Rating:          asset.Rating,
+		RatingCount:     asset.RatingCount,
+		PublishedAt:     asset.PublishedAt,
+		UpdatedAt:       asset.UpdatedAt,
+		FullDescription: asset.FullDescription,
+	}
+}
@@ -0,0 +1,111 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Kinds of crawl errors, as reported by ErrorKind.
+const (
+	KindThrottled = "throttled"
+	KindStatus    = "http_status"
+	KindNetwork   = "network"
+	KindDecode    = "decode"
+	KindParse     = "parse"
+	KindCancelled = "cancelled"
+	KindUnknown   = "unknown"
+)
+
+// ThrottledError is returned when itch.io kept answering with 429 Too Many
+// Requests until the retry policy gave up.
+type ThrottledError struct {
+	URL      string
+	Attempts int
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("throttled on %s, gave up after %d attempts", e.URL, e.Attempts)
+}
+
+// StatusError is returned for a response with an unexpected status code.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code for %s: %s", e.URL, e.Status)
+}
+
+// NetworkError is returned when a request could not be completed at all.
+type NetworkError struct {
+	URL string
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("failed to fetch %s: %v", e.URL, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// DecodeError is returned when a response body is not the JSON we expected.
+type DecodeError struct {
+	URL string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode response of %s: %v", e.URL, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// ParseError is returned when the HTML of a page could not be parsed. What
+// names what failed to parse if it was not a listing page, such as the
+// result count.
+type ParseError struct {
+	Page int64
+	What string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	switch {
+	case e.What != "":
+		return fmt.Sprintf("failed to parse %s: %v", e.What, e.Err)
+	case e.Page == 0:
+		return fmt.Sprintf("failed to parse document: %v", e.Err)
+	}
+	return fmt.Sprintf("failed to parse page %d: %v", e.Page, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ErrorKind classifies err into one of the Kind constants, so failures can be
+// counted by their cause.
+func ErrorKind(err error) string {
+	var throttled *ThrottledError
+	var status *StatusError
+	var network *NetworkError
+	var decode *DecodeError
+	var parse *ParseError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return KindCancelled
+	case errors.As(err, &throttled):
+		return KindThrottled
+	case errors.As(err, &status):
+		return KindStatus
+	case errors.As(err, &network):
+		return KindNetwork
+	case errors.As(err, &decode):
+		return KindDecode
+	case errors.As(err, &parse):
+		return KindParse
+	default:
+		return KindUnknown
+	}
+}
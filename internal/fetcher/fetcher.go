@@ -1,21 +1,69 @@
 package fetcher
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"itchgrep/internal/logging"
+	"io"
 	"itchgrep/pkg/models"
-	"math"
-	"math/rand"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+const (
+	DefaultBaseURL   = "https://itch.io/game-assets"
+	DefaultUserAgent = "itchgrep (+https://itchgrep.com)"
+)
+
+// Config holds the settings a Fetcher is created with. Zero values are
+// replaced by the package defaults.
+type Config struct {
+	Client    *http.Client
+	BaseURL   string // the listing to crawl, without a trailing slash
+	UserAgent string
+	Retry     RetryPolicy
+	Limiter   *RateLimiter // shared by all requests, nil means no limit
+}
+
+// Fetcher retrieves asset listings from itch.io, or from anything that
+// serves the same responses under BaseURL.
+type Fetcher struct {
+	client    *http.Client
+	baseURL   string
+	userAgent string
+	retry     RetryPolicy
+	limiter   *RateLimiter
+}
+
+// NewFetcher creates a Fetcher from cfg, falling back to the package defaults
+// for anything cfg leaves unset.
+func NewFetcher(cfg Config) *Fetcher {
+	f := &Fetcher{
+		client:    cfg.Client,
+		baseURL:   strings.TrimSuffix(cfg.BaseURL, "/"),
+		userAgent: cfg.UserAgent,
+		retry:     cfg.Retry,
+		limiter:   cfg.Limiter,
+	}
+	if f.client == nil {
+		f.client = http.DefaultClient
+	}
+	if f.baseURL == "" {
+		f.baseURL = DefaultBaseURL
+	}
+	if f.userAgent == "" {
+		f.userAgent = DefaultUserAgent
+	}
+	if f.retry.MaxAttempts <= 0 {
+		f.retry = DefaultRetryPolicy
+	}
+	return f
+}
+
 type itchResponse struct {
 	NumItems int64  `json:"num_items"`
 	Page     int64  `json:"page"`
@@ -26,7 +74,7 @@ func ParseAssetPage(respData itchResponse, pageNum int64) ([]models.Asset, error
 	// parse html
 	queryDoc, err := goquery.NewDocumentFromReader(strings.NewReader(respData.Content))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+		return nil, &ParseError{Page: pageNum, Err: err}
 	}
 
 	// iterate over each asset
@@ -40,103 +88,167 @@ func ParseAssetPage(respData itchResponse, pageNum int64) ([]models.Asset, error
 		linkNode := s.Find(".thumb_link")
 		link, _ := linkNode.Attr("href")
 		thumbUrl, _ := linkNode.Children().First().Attr("data-lazy_src")
+		// an unrecognized price is left empty rather than failing the page
+		price, _ := ParseListingPrice(s)
 		assets = append(assets, models.Asset{
-			GameId:        gameId,
-			Title:         title,
-			Author:        author,
-			Description:   description,
-			Link:          link,
-			ThumbUrl:      thumbUrl,
-			InvPopularity: pageNum,
+			GameId:          gameId,
+			Source:          ItchSourceName,
+			Title:           title,
+			Author:          author,
+			Description:     description,
+			Link:            link,
+			ThumbUrl:        thumbUrl,
+			InvPopularity:   pageNum,
+			Free:            price.Free,
+			PriceCents:      price.Cents,
+			Currency:        price.Currency,
+			DiscountPercent: price.DiscountPercent,
 		})
 	})
 	return assets, nil
 }
 
-func FetchAssetPage(pageNum int64) (itchResponse, bool) {
-	maxAttempts := 21
-	baseDelay := 1 * time.Second
-
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		// Construct the URL with the page number
-		url := fmt.Sprintf("https://itch.io/game-assets?page=%d&format=json", pageNum)
-		resp, err := http.Get(url)
-		if err != nil {
-			logging.Warning("Failed to fetch data at attempt %d: %v", attempt, err)
-			if attempt < maxAttempts-1 {
-				time.Sleep(calculateBackoff(attempt, baseDelay))
-			}
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusTooManyRequests {
-			logging.Warning("Too many requests, waiting and retrying")
-			if attempt < maxAttempts-1 {
-				time.Sleep(calculateBackoff(attempt, baseDelay))
-			}
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			logging.Error("Unexpected status code: %d %s", resp.StatusCode, resp.Status)
-			resp.Body.Close()
-			return itchResponse{}, false
-		}
-
-		var respData itchResponse
-		if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
-			logging.Error("Failed to decode response: %v", err)
-			return itchResponse{}, false
-		}
-		return respData, true
-	}
-
-	logging.Error("Failed to fetch data after %d attempts", maxAttempts)
-	return itchResponse{}, false
+// get performs a GET request against url, identifying as the configured user
+// agent. If the fetcher has a rate limiter, get waits for its turn and
+// reports back whether the request was throttled.
+func (f *Fetcher) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+
+	if f.limiter == nil {
+		return f.client.Do(req)
+	}
+	if err := f.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		f.limiter.Throttled()
+	} else if resp.StatusCode == http.StatusOK {
+		f.limiter.Succeeded()
+	}
+	return resp, nil
+}
+
+// FetchAssetPage fetches one page of the listing. The returned error is one
+// of the typed errors of this package, or the context's error.
+func (f *Fetcher) FetchAssetPage(ctx context.Context, pageNum int64) (itchResponse, error) {
+	return f.FetchListingPage(ctx, "", pageNum)
 }
 
-// calculateBackoff calculates the delay for the next retry attempt using
-// exponential backoff with jitter.
-func calculateBackoff(attempt int, baseDelay time.Duration) time.Duration {
-	// Exponential backoff factor
-	expFactor := math.Pow(1.36, float64(attempt))
-	// Add jitter by introducing randomness
-	jitter := rand.Float64() * expFactor * float64(baseDelay)
-	return time.Duration(jitter)
+// listingURL returns the URL of a listing below the base URL, e.g. "newest"
+// for https://itch.io/game-assets/newest. The empty listing is the base URL
+// itself.
+func (f *Fetcher) listingURL(listing string) string {
+	listing = strings.Trim(listing, "/")
+	if listing == "" {
+		return f.baseURL
+	}
+	return f.baseURL + "/" + listing
+}
+
+// FetchListingPage fetches one page of a listing below the base URL, such as
+// "newest". It behaves like FetchAssetPage otherwise.
+func (f *Fetcher) FetchListingPage(ctx context.Context, listing string, pageNum int64) (itchResponse, error) {
+	// Construct the URL with the page number
+	url := fmt.Sprintf("%s?page=%d&format=json", f.listingURL(listing), pageNum)
+	resp, err := f.do(ctx, url)
+	if err != nil {
+		return itchResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return itchResponse{}, &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var respData itchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return itchResponse{}, &DecodeError{URL: url, Err: err}
+	}
+	return respData, nil
+}
+
+func (f *Fetcher) GetAssetCount(ctx context.Context) (int64, error) {
+	return f.GetListingAssetCount(ctx, "")
+}
+
+// GetListingAssetCount returns the number of assets in a listing below the
+// base URL, see FetchListingPage.
+func (f *Fetcher) GetListingAssetCount(ctx context.Context, listing string) (int64, error) {
+	queryDoc, err := f.FetchDocument(ctx, f.listingURL(listing))
+	if err != nil {
+		return 0, err
+	}
+
+	// parse "(53,665 results)" -> 53665
+	resultCountStr := queryDoc.Find(".game_count").Text()
+	re := regexp.MustCompile(`[\d,]+`)
+	match := re.FindString(resultCountStr)
+	numberStr := strings.ReplaceAll(match, ",", "")
+	number, err := strconv.ParseInt(numberStr, 10, 64)
+	if err != nil {
+		return 0, &ParseError{What: "result count", Err: fmt.Errorf("%q: %w", resultCountStr, err)}
+	}
+	return number, nil
+}
+
+// FetchDocument fetches and parses the HTML page at url. Like every request
+// of the fetcher, it is rate limited and retried.
+func (f *Fetcher) FetchDocument(ctx context.Context, url string) (*goquery.Document, error) {
+	resp, err := f.do(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	queryDoc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	return queryDoc, nil
+}
+
+// maxFileSize bounds the size of the files FetchFile downloads.
+const maxFileSize = 10 << 20
+
+// FetchFile downloads the file at url, such as a thumbnail, into memory.
+func (f *Fetcher) FetchFile(ctx context.Context, url string) ([]byte, error) {
+	resp, err := f.do(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFileSize+1))
+	if err != nil {
+		return nil, &NetworkError{URL: url, Err: err}
+	}
+	if len(data) > maxFileSize {
+		return nil, &DecodeError{URL: url, Err: fmt.Errorf("file is larger than %d bytes", maxFileSize)}
+	}
+	return data, nil
 }
 
-func GetAssetCount() (int64, error) {
-	for {
-		resp, err := http.Get("https://itch.io/game-assets")
-		if err != nil {
-			return 0, fmt.Errorf("failed to fetch page: %w", err)
-		}
-
-		if resp.StatusCode == http.StatusOK {
-			defer resp.Body.Close()
-			queryDoc, err := goquery.NewDocumentFromReader(resp.Body)
-			if err != nil {
-				return 0, fmt.Errorf("failed to parse HTML: %w", err)
-			}
-
-			// parse "(53,665 results)" -> 53665
-			resultCountStr := queryDoc.Find(".game_count").Text()
-			re := regexp.MustCompile(`[\d,]+`)
-			match := re.FindString(resultCountStr)
-			numberStr := strings.ReplaceAll(match, ",", "")
-			number, err := strconv.ParseInt(numberStr, 10, 64)
-			if err != nil {
-				return 0, fmt.Errorf("failed to parse result count: %w", err)
-			}
-			return number, nil
-		} else if resp.StatusCode == 429 {
-			// Too Many Requests, wait a second and retry
-			time.Sleep(4 * time.Second)
-			continue
-		} else {
-			resp.Body.Close() // Ensure the response body is closed before returning
-			return 0, fmt.Errorf("unexpected status code: %d %s", resp.StatusCode, resp.Status)
-		}
+// Limit returns the current request rate of the fetcher in requests per
+// second, or zero if it is not rate limited.
+func (f *Fetcher) Limit() float64 {
+	if f.limiter == nil {
+		return 0
 	}
+	return f.limiter.Limit()
 }
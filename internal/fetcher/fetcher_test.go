@@ -0,0 +1,481 @@
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"itchgrep/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testListingContent = `
+<div class="game_cell" data-game_id="42">
+	<a class="thumb_link" href="https://someone.itch.io/bones"><img data-lazy_src="https://img.itch.zone/bones.png"/></a>
+	<div class="game_cell_data">
+		<div class="game_title"><a class="title">Bones</a></div>
+		<div class="game_text">A pile of bones</div>
+		<div class="game_author"><a href="https://someone.itch.io">someone</a></div>
+	</div>
+</div>`
+
+func newTestFetcher(server *httptest.Server) *Fetcher {
+	return NewFetcher(Config{
+		Client:    server.Client(),
+		BaseURL:   server.URL + "/game-assets",
+		UserAgent: "itchgrep-test",
+		Retry:     RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	})
+}
+
+func TestFetchAssetPageUsesConfiguredServer(t *testing.T) {
+	var gotUserAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserAgent = r.UserAgent()
+		assert.Equal(t, "/game-assets", r.URL.Path)
+		assert.Equal(t, "2", r.URL.Query().Get("page"))
+		json.NewEncoder(w).Encode(itchResponse{NumItems: 1, Page: 2, Content: testListingContent})
+	}))
+	defer server.Close()
+
+	respData, err := newTestFetcher(server).FetchAssetPage(context.Background(), 2)
+	require.NoError(t, err, "FetchAssetPage should succeed")
+	assert.Equal(t, "itchgrep-test", gotUserAgent)
+
+	assets, err := ParseAssetPage(respData, 2)
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+	assert.Equal(t, "42", assets[0].GameId)
+	assert.Equal(t, "Bones", assets[0].Title)
+	assert.Equal(t, "someone", assets[0].Author)
+	assert.Equal(t, "https://img.itch.zone/bones.png", assets[0].ThumbUrl)
+	assert.Equal(t, int64(2), assets[0].InvPopularity)
+}
+
+func TestFetchAssetPageRetriesWhenThrottled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(itchResponse{NumItems: 1, Page: 1})
+	}))
+	defer server.Close()
+
+	_, err := newTestFetcher(server).FetchAssetPage(context.Background(), 1)
+	assert.NoError(t, err, "FetchAssetPage should succeed after a retry")
+	assert.Equal(t, 2, requests)
+}
+
+func TestGetAssetCount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><span class="game_count">(53,665 results)</span></body></html>`))
+	}))
+	defer server.Close()
+
+	count, err := newTestFetcher(server).GetAssetCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(53665), count)
+}
+
+func TestGetAssetCountWithoutResultCount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>No results</body></html>`))
+	}))
+	defer server.Close()
+
+	_, err := newTestFetcher(server).GetAssetCount(context.Background())
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Contains(t, err.Error(), "failed to parse result count")
+	assert.NotContains(t, err.Error(), "page 0")
+}
+
+func TestFetchAssetPageStopsWhenCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	f := newTestFetcher(server)
+	f.retry = RetryPolicy{MaxAttempts: 100, BaseDelay: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := f.FetchAssetPage(ctx, 1)
+	assert.Equal(t, KindCancelled, ErrorKind(err), "FetchAssetPage should give up once the context is done")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestForEachBoundsConcurrency(t *testing.T) {
+	items := make([]int, 50)
+	var running, maxRunning, calls atomic.Int64
+	ForEach(context.Background(), 4, items, func(ctx context.Context, item int) {
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		calls.Add(1)
+	})
+	assert.Equal(t, int64(50), calls.Load())
+	assert.LessOrEqual(t, maxRunning.Load(), int64(4))
+}
+
+func TestRateLimiterAdaptsToThrottling(t *testing.T) {
+	l := NewRateLimiter(10, 1)
+	l.Throttled()
+	assert.InDelta(t, 5, l.Limit(), 0.001, "a 429 should halve the rate")
+	l.Succeeded()
+	assert.InDelta(t, 5.1, l.Limit(), 0.001, "a success should add one step")
+	for i := 0; i < 1000; i++ {
+		l.Succeeded()
+	}
+	assert.InDelta(t, 10, l.Limit(), 0.001, "the rate should never exceed the maximum")
+	for i := 0; i < 1000; i++ {
+		l.Throttled()
+	}
+	assert.InDelta(t, 10.0/64, l.Limit(), 0.001, "the rate should never drop below the minimum")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	d, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+
+	d, ok = parseRetryAfter("Fri, 01 Mar 2024 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
+
+func TestGetAssetCountRetriesServerErrorsAndHonorsRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte(`<span class="game_count">(12 results)</span>`))
+		}
+	}))
+	defer server.Close()
+
+	f := newTestFetcher(server)
+	f.retry.BaseDelay = time.Hour // only the Retry-After header can keep this fast
+	f.retry.MaxDelay = 10 * time.Millisecond
+	count, err := f.GetAssetCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), count)
+	assert.Equal(t, 3, requests)
+}
+
+func TestFetchAssetPageDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := newTestFetcher(server).FetchAssetPage(context.Background(), 1)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	assert.Equal(t, 1, requests)
+}
+
+func TestRetryGivesUpAfterMaxElapsed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	f := newTestFetcher(server)
+	f.retry = RetryPolicy{MaxAttempts: 10, BaseDelay: time.Millisecond, MaxElapsed: time.Minute}
+	start := time.Now()
+	_, err := f.GetAssetCount(context.Background())
+	assert.Equal(t, KindThrottled, ErrorKind(err))
+	assert.Less(t, time.Since(start), 5*time.Second, "a Retry-After beyond the budget should not be waited for")
+}
+
+func TestReportRecorder(t *testing.T) {
+	r := NewReportRecorder(3)
+	r.PageSucceeded(ItchSourceName, 1, []models.Asset{{GameId: "1", Title: "a", Author: "b", Link: "c", ThumbUrl: "d"}}, time.Second)
+	r.PageFailed(ItchSourceName, 3, &ThrottledError{URL: "x", Attempts: 21}, 3*time.Second)
+	r.PageFailed(ItchSourceName, 2, &DecodeError{URL: "y"}, 2*time.Second)
+	report := r.Finish(30)
+
+	assert.Equal(t, int64(3), report.PagesAttempted)
+	assert.Equal(t, int64(1), report.PagesSucceeded)
+	assert.Equal(t, int64(2), report.PagesFailed)
+	assert.Equal(t, int64(30), report.AssetCount)
+	assert.Equal(t, map[string]int64{KindThrottled: 1, KindDecode: 1}, report.FailuresByKind)
+	require.Len(t, report.Failures, 2)
+	assert.Equal(t, int64(2), report.Failures[0].Page, "failures should be sorted by page")
+	assert.InDelta(t, 2, report.AvgPageSeconds, 0.001)
+	assert.InDelta(t, 3, report.MaxPageSeconds, 0.001)
+	assert.Equal(t, int64(1), report.FillRates.Assets)
+	assert.Empty(t, report.DriftFailures)
+}
+
+func TestParseAssetPageFixtures(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		assets    []models.Asset
+		warnings  int // drift warnings of the page
+		driftFail bool
+	}{
+		{
+			fixture: "listing_current.html",
+			assets: []models.Asset{
+				{
+					GameId:        "2178201",
+					Source:        ItchSourceName,
+					Title:         "Pixel Adventure",
+					Author:        "Pixel Frog",
+					Description:   "Free 2D platformer asset pack",
+					Link:          "https://pixelfrog.itch.io/pixel-adventure",
+					ThumbUrl:      "https://img.itch.zone/aW1nLzEyMzQ1Ng==/315x250%23c/pixel.png",
+					InvPopularity: 7,
+					Free:          true,
+				},
+				{
+					// descriptions are optional
+					GameId:          "1093325",
+					Source:          ItchSourceName,
+					Title:           "UI Pack",
+					Author:          "Kenney",
+					Link:            "https://kenney-assets.itch.io/ui-pack",
+					ThumbUrl:        "https://img.itch.zone/aW1nLzY1NDMyMQ==/315x250%23c/ui.png",
+					InvPopularity:   7,
+					PriceCents:      250,
+					Currency:        "USD",
+					DiscountPercent: 50,
+				},
+			},
+		},
+		{
+			fixture:   "listing_renamed_cells.html",
+			assets:    []models.Asset{},
+			warnings:  1,
+			driftFail: true,
+		},
+		{
+			fixture: "listing_lazy_src_renamed.html",
+			assets: []models.Asset{
+				{
+					GameId:        "2178201",
+					Source:        ItchSourceName,
+					Author:        "Pixel Frog",
+					Description:   "Free 2D platformer asset pack",
+					Link:          "https://pixelfrog.itch.io/pixel-adventure",
+					InvPopularity: 7,
+					Free:          true,
+				},
+			},
+			warnings:  2,
+			driftFail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			require.NoError(t, err)
+
+			assets, err := ParseAssetPage(itchResponse{Content: string(content)}, 7)
+			require.NoError(t, err)
+			assert.Equal(t, tt.assets, assets)
+
+			r := NewReportRecorder(1)
+			warnings := r.PageSucceeded(ItchSourceName, 7, assets, time.Second)
+			assert.Len(t, warnings, tt.warnings)
+			report := r.Finish(len(assets))
+			assert.Equal(t, tt.driftFail, len(report.DriftFailures) > 0, "drift failures: %v", report.DriftFailures)
+		})
+	}
+}
+
+const testDetailsPage = `<html><body>
+<div class="formatted_description user_formatted"><p>Over 200 hand drawn bones.</p></div>
+<div class="buy_row"><span itemprop="offers"><meta itemprop="priceCurrency" content="USD"/><meta itemprop="price" content="4.99"/><span class="dollars">$4.99</span></span></div>
+<div class="upload_list_widget">
+	<div class="upload"><div class="upload_name"><strong class="name" title="bones.zip">bones.zip</strong> <span class="file_size"><span>2 MB</span></span></div></div>
+	<div class="upload"><div class="upload_name"><strong class="name" title="bones_extra.zip">bones_extra.zip</strong> <span class="file_size"><span>512 kB</span></span></div></div>
+</div>
+<div class="game_info_panel_widget"><table><tbody>
+	<tr><td>Updated</td><td><abbr title="15 February 2024 @ 10:16 UTC">12 days ago</abbr></td></tr>
+	<tr><td>Published</td><td><abbr title="02 January 2023 @ 08:00 UTC">Jan 02, 2023</abbr></td></tr>
+	<tr><td>Rating</td><td><div class="aggregate_rating"><span itemprop="ratingValue" content="4.75"></span><span itemprop="ratingCount" content="12">(12 total ratings)</span></div></td></tr>
+	<tr><td>Tags</td><td><a href="/game-assets/tag-2d">2D</a>, <a href="/game-assets/tag-pixel-art">Pixel Art</a></td></tr>
+	<tr><td>Asset license</td><td><a href="https://creativecommons.org/publicdomain/zero/1.0/">Creative Commons Zero v1.0 Universal</a></td></tr>
+</tbody></table></div>
+</body></html>`
+
+func TestParseAssetDetails(t *testing.T) {
+	details, err := ParseAssetDetails(strings.NewReader(testDetailsPage))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Over 200 hand drawn bones.", details.FullDescription)
+	assert.Equal(t, &ListingPrice{Cents: 499, Currency: "USD"}, details.Price)
+	assert.Equal(t, []string{"2D", "Pixel Art"}, details.Tags)
+	assert.Equal(t, "Creative Commons Zero v1.0 Universal", details.License)
+	assert.Equal(t, 4.75, details.Rating)
+	assert.Equal(t, int64(12), details.RatingCount)
+	require.NotNil(t, details.UpdatedAt)
+	assert.Equal(t, time.Date(2024, 2, 15, 10, 16, 0, 0, time.UTC), *details.UpdatedAt)
+	require.NotNil(t, details.PublishedAt)
+	assert.Equal(t, time.Date(2023, 1, 2, 8, 0, 0, 0, time.UTC), *details.PublishedAt)
+	assert.Equal(t, []models.AssetFile{{Name: "bones.zip", Size: "2 MB"}, {Name: "bones_extra.zip", Size: "512 kB"}}, details.Files)
+}
+
+func TestRecordAndReplayCassette(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(itchResponse{NumItems: 1, Page: 1, Content: testListingContent})
+	}))
+	cassette := t.TempDir()
+
+	recorder := NewFetcher(Config{
+		Client:  &http.Client{Transport: &RecordingTransport{Dir: cassette, Transport: server.Client().Transport}},
+		BaseURL: server.URL,
+	})
+	recorded, err := recorder.FetchAssetPage(context.Background(), 1)
+	require.NoError(t, err)
+	server.Close() // from here on, everything has to come from the cassette
+
+	replayer := NewFetcher(Config{
+		Client:  &http.Client{Transport: &ReplayTransport{Dir: cassette}},
+		BaseURL: server.URL,
+		Retry:   RetryPolicy{MaxAttempts: 1},
+	})
+	replayed, err := replayer.FetchAssetPage(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, recorded, replayed)
+
+	_, err = replayer.FetchAssetPage(context.Background(), 2)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr, "pages that were never recorded should not be found")
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+}
+
+func TestWriteCassetteEntryConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "entry.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, writeCassetteEntry(path, cassetteEntry{Method: "GET", URL: "https://example.com", Body: []byte("body")}))
+		}()
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no temporary files are left behind")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var entry cassetteEntry
+	require.NoError(t, json.Unmarshal(data, &entry))
+	assert.Equal(t, "body", string(entry.Body))
+}
+
+func TestHTMLSource(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "opengameart_search.html"))
+	require.NoError(t, err)
+	var requestedPages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPages = append(requestedPages, r.URL.Query().Get("page"))
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	source, err := NewHTMLSource(newTestFetcher(server), HTMLSourceConfig{
+		Name:             "opengameart",
+		PageURL:          server.URL + "/art-search-advanced?sort_by=count&page=%d",
+		FirstPage:        0,
+		LastPageSelector: ".pager-last a",
+		Item:             ".view-content .views-row",
+		Title:            HTMLField{Selector: ".art-preview-title a"},
+		Link:             HTMLField{Selector: ".art-preview-title a", Attr: "href"},
+		Thumb:            HTMLField{Selector: ".field-name-field-art-preview img", Attr: "src"},
+	})
+	require.NoError(t, err)
+
+	pages, err := source.PageCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1235), pages, "OpenGameArt counts pages from 0")
+
+	assets, err := source.FetchPage(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0", "2"}, requestedPages)
+	require.Len(t, assets, 2)
+	assert.Equal(t, models.Asset{
+		GameId:        "opengameart:content/lpc-base-assets",
+		Source:        "opengameart",
+		Title:         "LPC Base Assets",
+		Link:          server.URL + "/content/lpc-base-assets",
+		ThumbUrl:      "https://opengameart.org/sites/default/files/styles/thumbnail/public/lpc_base.png",
+		InvPopularity: 3,
+	}, assets[0])
+
+	// the source has no author selector, so missing authors are no drift
+	r := NewReportRecorder(1)
+	r.SetDriftThresholds(source.Name(), DriftThresholdsOf(source))
+	assert.Empty(t, r.PageSucceeded(source.Name(), 3, assets, time.Second))
+	assert.Empty(t, r.Finish(len(assets)).DriftFailures)
+}
+
+func TestParsePriceText(t *testing.T) {
+	tests := []struct {
+		text  string
+		price ListingPrice
+	}{
+		{"$4.99", ListingPrice{Cents: 499, Currency: "USD"}},
+		{"€4,99", ListingPrice{Cents: 499, Currency: "EUR"}},
+		{"R$10.00", ListingPrice{Cents: 1000, Currency: "BRL"}},
+		{"$1,000", ListingPrice{Cents: 100000, Currency: "USD"}},
+		{"$1,234.56", ListingPrice{Cents: 123456, Currency: "USD"}},
+		{"€1.234,56", ListingPrice{Cents: 123456, Currency: "EUR"}},
+		{"€1.234.567,89", ListingPrice{Cents: 123456789, Currency: "EUR"}},
+		{"¥500", ListingPrice{Cents: 50000, Currency: "JPY"}},
+		{"$0.00", ListingPrice{Free: true, Currency: "USD"}},
+	}
+	for _, tt := range tests {
+		price, err := parsePriceText(tt.text)
+		require.NoError(t, err, tt.text)
+		assert.Equal(t, tt.price, price, tt.text)
+	}
+
+	_, err := parsePriceText("Name your own price")
+	assert.ErrorIs(t, err, errUnrecognizedPrice)
+}
@@ -0,0 +1,191 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"itchgrep/pkg/models"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// HTMLField tells an HTMLSource where to find a field of an asset inside its
+// item. Without Attr, the text of the first match is used.
+type HTMLField struct {
+	Selector string
+	Attr     string `json:",omitempty"`
+}
+
+// HTMLSourceConfig describes a catalogue whose listing pages are plain HTML,
+// like OpenGameArt's art search or Kenney's asset pages. It is usually read
+// from the JSON file named by SOURCES_FILE.
+type HTMLSourceConfig struct {
+	Name string
+
+	// PageURL is the URL of a listing page, with a %d for the page number.
+	// FirstPage is the number of the first page in that URL, since some
+	// catalogues count from 0.
+	PageURL   string
+	FirstPage int64
+
+	// Pages fixes the number of pages to crawl. If it is zero, the number is
+	// read from the link to the last page, which is found with
+	// LastPageSelector on the first page and has the page number as the
+	// last number in its href.
+	Pages            int64
+	LastPageSelector string
+
+	// Free marks every asset of the catalogue as free, for catalogues that
+	// do not sell anything.
+	Free bool `json:",omitempty"`
+
+	// Item selects every asset on a listing page, the fields below are
+	// relative to it. Without Id, the path of the link identifies the asset.
+	// Relative links are resolved against the listing page.
+	Item        string
+	Id          HTMLField
+	Title       HTMLField
+	Author      HTMLField
+	Description HTMLField
+	Link        HTMLField
+	Thumb       HTMLField
+}
+
+// HTMLSource crawls a catalogue described by an HTMLSourceConfig.
+type HTMLSource struct {
+	fetcher *Fetcher
+	cfg     HTMLSourceConfig
+}
+
+// NewHTMLSource creates a source that fetches the pages described by cfg
+// through f, so that it shares the rate limit and transport of f.
+func NewHTMLSource(f *Fetcher, cfg HTMLSourceConfig) (*HTMLSource, error) {
+	if cfg.Name == "" || cfg.Name == ItchSourceName {
+		return nil, fmt.Errorf("invalid source name %q", cfg.Name)
+	}
+	if strings.Count(cfg.PageURL, "%d") != 1 {
+		return nil, fmt.Errorf("source %s: PageURL must contain exactly one %%d", cfg.Name)
+	}
+	if cfg.Item == "" || cfg.Title.Selector == "" || cfg.Link.Selector == "" {
+		return nil, fmt.Errorf("source %s: Item, Title and Link selectors are required", cfg.Name)
+	}
+	if cfg.Pages <= 0 && cfg.LastPageSelector == "" {
+		return nil, fmt.Errorf("source %s: either Pages or LastPageSelector is required", cfg.Name)
+	}
+	return &HTMLSource{fetcher: f, cfg: cfg}, nil
+}
+
+func (s *HTMLSource) Name() string {
+	return s.cfg.Name
+}
+
+// pageURL returns the URL of pageNum, counting from 1.
+func (s *HTMLSource) pageURL(pageNum int64) string {
+	return fmt.Sprintf(s.cfg.PageURL, pageNum-1+s.cfg.FirstPage)
+}
+
+var lastNumberRegexp = regexp.MustCompile(`\d+`)
+
+func (s *HTMLSource) PageCount(ctx context.Context) (int64, error) {
+	if s.cfg.Pages > 0 {
+		return s.cfg.Pages, nil
+	}
+
+	queryDoc, err := s.fetcher.FetchDocument(ctx, s.pageURL(1))
+	if err != nil {
+		return 0, err
+	}
+	href, _ := queryDoc.Find(s.cfg.LastPageSelector).First().Attr("href")
+	numbers := lastNumberRegexp.FindAllString(href, -1)
+	if len(numbers) == 0 {
+		// a catalogue with a single page has no pager
+		return 1, nil
+	}
+	lastPage, err := strconv.ParseInt(numbers[len(numbers)-1], 10, 64)
+	if err != nil {
+		return 0, &ParseError{Page: 1, Err: fmt.Errorf("failed to parse last page: %w", err)}
+	}
+	return lastPage - s.cfg.FirstPage + 1, nil
+}
+
+func (s *HTMLSource) FetchPage(ctx context.Context, pageNum int64) ([]models.Asset, error) {
+	pageURL := s.pageURL(pageNum)
+	queryDoc, err := s.fetcher.FetchDocument(ctx, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	return s.ParsePage(queryDoc, pageURL, pageNum)
+}
+
+// ParsePage reads the assets from a listing page of the source, which was
+// fetched from pageURL.
+func (s *HTMLSource) ParsePage(queryDoc *goquery.Document, pageURL string, pageNum int64) ([]models.Asset, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, &ParseError{Page: pageNum, Err: err}
+	}
+
+	assets := make([]models.Asset, 0)
+	queryDoc.Find(s.cfg.Item).Each(func(i int, item *goquery.Selection) {
+		link := resolveURL(base, fieldValue(item, s.cfg.Link))
+		id := fieldValue(item, s.cfg.Id)
+		if s.cfg.Id.Selector == "" && link != "" {
+			if u, err := url.Parse(link); err == nil {
+				id = strings.Trim(u.Path, "/")
+			}
+		}
+		if id != "" {
+			id = s.cfg.Name + ":" + id
+		}
+		assets = append(assets, models.Asset{
+			GameId:        id,
+			Source:        s.cfg.Name,
+			Title:         fieldValue(item, s.cfg.Title),
+			Author:        fieldValue(item, s.cfg.Author),
+			Description:   fieldValue(item, s.cfg.Description),
+			Link:          link,
+			ThumbUrl:      resolveURL(base, fieldValue(item, s.cfg.Thumb)),
+			InvPopularity: pageNum,
+			Free:          s.cfg.Free,
+		})
+	})
+	return assets, nil
+}
+
+// DriftThresholds leaves out the fields the source has no selector for.
+func (s *HTMLSource) DriftThresholds() DriftThresholds {
+	thresholds := DefaultDriftThresholds
+	if s.cfg.Author.Selector == "" {
+		thresholds.Warn.Author, thresholds.Fail.Author = 0, 0
+	}
+	if s.cfg.Thumb.Selector == "" {
+		thresholds.Warn.ThumbUrl, thresholds.Fail.ThumbUrl = 0, 0
+	}
+	return thresholds
+}
+
+func fieldValue(item *goquery.Selection, field HTMLField) string {
+	if field.Selector == "" {
+		return ""
+	}
+	match := item.Find(field.Selector).First()
+	if field.Attr != "" {
+		value, _ := match.Attr(field.Attr)
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(match.Text())
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
@@ -0,0 +1,38 @@
+package fetcher
+
+import (
+	"context"
+	"sync"
+)
+
+// ForEach calls fn for every item, with at most workers calls running at the
+// same time. Once ctx is done no further items are handed out; ForEach
+// returns after all calls that were already started have finished.
+func ForEach[T any](ctx context.Context, workers int, items []T, fn func(ctx context.Context, item T)) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan T)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				fn(ctx, item)
+			}
+		}()
+	}
+
+feed:
+	for _, item := range items {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- item:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
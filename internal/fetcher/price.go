@@ -0,0 +1,95 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// currencySymbols maps the symbols itch.io shows in listings to ISO 4217
+// codes. Longer symbols come first, so that "R$" is not taken for "$".
+var currencySymbols = []struct{ symbol, code string }{
+	{"R$", "BRL"},
+	{"CA$", "CAD"},
+	{"A$", "AUD"},
+	{"$", "USD"},
+	{"€", "EUR"},
+	{"£", "GBP"},
+	{"¥", "JPY"},
+	{"₹", "INR"},
+	{"₩", "KRW"},
+}
+
+// ListingPrice is the price of an asset as shown on its listing cell.
+type ListingPrice struct {
+	Free            bool
+	Cents           int64
+	Currency        string
+	DiscountPercent int64
+}
+
+var (
+	priceAmountRegexp    = regexp.MustCompile(`\d[\d,.]*`)
+	discountRegexp       = regexp.MustCompile(`(\d+)\s*%`)
+	errUnrecognizedPrice = errors.New("unrecognized price")
+)
+
+// ParseListingPrice reads the price and sale badges of a .game_cell. Cells
+// without a price tag, or with a price of zero, belong to free assets.
+func ParseListingPrice(cell *goquery.Selection) (ListingPrice, error) {
+	priceText := strings.TrimSpace(cell.Find(".price_tag .price_value").First().Text())
+	if priceText == "" || strings.EqualFold(priceText, "free") {
+		return ListingPrice{Free: true}, nil
+	}
+
+	price, err := parsePriceText(priceText)
+	if err != nil {
+		return ListingPrice{}, err
+	}
+	if match := discountRegexp.FindStringSubmatch(cell.Find(".sale_tag").First().Text()); match != nil {
+		price.DiscountPercent, _ = strconv.ParseInt(match[1], 10, 64)
+	}
+	return price, nil
+}
+
+// parsePriceText parses prices like "$4.99", "€4,99" or "¥500" into
+// hundredths of their currency.
+func parsePriceText(priceText string) (ListingPrice, error) {
+	amount := priceAmountRegexp.FindString(priceText)
+	if amount == "" {
+		return ListingPrice{}, fmt.Errorf("%w: %q", errUnrecognizedPrice, priceText)
+	}
+
+	var price ListingPrice
+	symbol := strings.TrimSpace(strings.Replace(priceText, amount, "", 1))
+	price.Currency = symbol
+	for _, c := range currencySymbols {
+		if symbol == c.symbol {
+			price.Currency = c.code
+			break
+		}
+	}
+
+	// if both appear, the last of a comma and a dot is the decimal
+	// separator, as in "1.234,56". A comma alone is the decimal separator if
+	// it is followed by exactly two digits, otherwise it separates thousands.
+	lastComma, lastDot := strings.LastIndex(amount, ","), strings.LastIndex(amount, ".")
+	switch {
+	case lastComma > lastDot && lastDot >= 0:
+		amount = strings.ReplaceAll(amount[:lastComma], ".", "") + "." + amount[lastComma+1:]
+	case lastComma >= 0 && lastDot < 0 && lastComma == len(amount)-3:
+		amount = amount[:lastComma] + "." + amount[lastComma+1:]
+	}
+	amount = strings.ReplaceAll(amount, ",", "")
+	value, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return ListingPrice{}, fmt.Errorf("%w: %q", errUnrecognizedPrice, priceText)
+	}
+	price.Cents = int64(value*100 + 0.5)
+	price.Free = price.Cents == 0
+	return price, nil
+}
@@ -0,0 +1,67 @@
+package fetcher
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter is a token bucket shared by every request of a Fetcher. It
+// backs off on its own when itch.io starts throttling: each 429 halves the
+// rate (multiplicative decrease), each successful request raises it by a
+// small step (additive increase), up to the configured maximum.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	max     rate.Limit
+	min     rate.Limit
+	step    rate.Limit
+}
+
+// NewRateLimiter creates a limiter allowing at most requestsPerSecond
+// requests per second, with bursts of up to burst requests.
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	max := rate.Limit(requestsPerSecond)
+	return &RateLimiter{
+		limiter: rate.NewLimiter(max, burst),
+		max:     max,
+		min:     max / 64,
+		step:    max / 100,
+	}
+}
+
+// Wait blocks until the next request may be sent, or until ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	return l.limiter.Wait(ctx)
+}
+
+// Throttled halves the current rate, never going below a 64th of the maximum.
+func (l *RateLimiter) Throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	newLimit := l.limiter.Limit() / 2
+	if newLimit < l.min {
+		newLimit = l.min
+	}
+	l.limiter.SetLimit(newLimit)
+}
+
+// Succeeded raises the current rate by one step, up to the maximum.
+func (l *RateLimiter) Succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	newLimit := l.limiter.Limit() + l.step
+	if newLimit > l.max {
+		newLimit = l.max
+	}
+	l.limiter.SetLimit(newLimit)
+}
+
+// Limit returns the current rate in requests per second.
+func (l *RateLimiter) Limit() float64 {
+	return float64(l.limiter.Limit())
+}
@@ -0,0 +1,269 @@
+package fetcher
+
+import (
+	"cmp"
+	"itchgrep/pkg/models"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportRecorder collects the outcome of every page of a crawl into a
+// models.CrawlReport. It is safe for concurrent use by the crawl workers.
+type ReportRecorder struct {
+	mu            sync.Mutex
+	report        models.CrawlReport
+	totalPageTime time.Duration
+	sources       map[string]*sourceRecord
+}
+
+// sourceRecord holds what the drift check needs to know about one source.
+type sourceRecord struct {
+	pages, emptyPages int64
+	fill              fillCounts
+	drift             DriftThresholds
+}
+
+// NewReportRecorder starts the report of a crawl over pagesTotal pages.
+func NewReportRecorder(pagesTotal int64) *ReportRecorder {
+	return &ReportRecorder{
+		report: models.CrawlReport{
+			StartedAt:            time.Now().UTC(),
+			PagesTotal:           pagesTotal,
+			FailuresByKind:       make(map[string]int64),
+			DetailFailuresByKind: make(map[string]int64),
+			ThumbFailuresByKind:  make(map[string]int64),
+		},
+		sources: make(map[string]*sourceRecord),
+	}
+}
+
+func (r *ReportRecorder) source(name string) *sourceRecord {
+	s, ok := r.sources[name]
+	if !ok {
+		s = &sourceRecord{drift: DefaultDriftThresholds}
+		r.sources[name] = s
+	}
+	return s
+}
+
+// SetDriftThresholds replaces the thresholds the fill rates of the pages of
+// a source are checked against, see DriftThresholdsOf.
+func (r *ReportRecorder) SetDriftThresholds(source string, thresholds DriftThresholds) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.source(source).drift = thresholds
+}
+
+// SetRunId records the ID of the run the report belongs to.
+func (r *ReportRecorder) SetRunId(runId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.RunId = runId
+}
+
+// SetPagesResumed records how many pages were taken over from an earlier,
+// interrupted attempt of the same run.
+func (r *ReportRecorder) SetPagesResumed(pages int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.PagesResumed = pages
+}
+
+// SetResumedFrom records the ID of the earlier run whose checkpoint the
+// crawl picked up.
+func (r *ReportRecorder) SetResumedFrom(runId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.ResumedFrom = runId
+}
+
+// SetMode records the kind of crawl, and when the last full crawl the result
+// builds on was started.
+func (r *ReportRecorder) SetMode(mode string, lastFullCrawlAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Mode = mode
+	r.report.LastFullCrawlAt = lastFullCrawlAt
+}
+
+// AddPagesTotal raises the number of pages the crawl is expected to cover,
+// for crawls that only find out how far to go while they are running.
+func (r *ReportRecorder) AddPagesTotal(pages int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.PagesTotal += pages
+}
+
+// SetPagesTotal updates the number of pages the crawl is expected to cover,
+// for when it is only known after the crawl has started.
+func (r *ReportRecorder) SetPagesTotal(pagesTotal int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.PagesTotal = pagesTotal
+}
+
+func (r *ReportRecorder) addPageTime(d time.Duration) {
+	r.report.PagesAttempted++
+	r.totalPageTime += d
+	if d.Seconds() > r.report.MaxPageSeconds {
+		r.report.MaxPageSeconds = d.Seconds()
+	}
+}
+
+// PageSucceeded records that pageNum of source was fetched and parsed into
+// assets in d. It returns the drift warnings of the page, if any.
+func (r *ReportRecorder) PageSucceeded(source string, pageNum int64, assets []models.Asset, d time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addPageTime(d)
+	r.report.PagesSucceeded++
+	s := r.source(source)
+	s.pages++
+	s.fill.add(assets)
+
+	warnings := s.drift.CheckPage(ComputeFillRates(assets))
+	page := models.PageRef{Source: source, Page: pageNum}
+	if len(assets) == 0 {
+		s.emptyPages++
+		r.report.EmptyPages = append(r.report.EmptyPages, page)
+	} else if len(warnings) > 0 {
+		r.report.LowFillPages = append(r.report.LowFillPages, page)
+	}
+	return warnings
+}
+
+// PageFailed records that pageNum of source could not be crawled because of
+// err.
+func (r *ReportRecorder) PageFailed(source string, pageNum int64, err error, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addPageTime(d)
+	kind := ErrorKind(err)
+	r.report.PagesFailed++
+	r.report.FailuresByKind[kind]++
+	r.report.Failures = append(r.report.Failures, models.PageFailure{
+		Source:          source,
+		Page:            pageNum,
+		Kind:            kind,
+		Reason:          err.Error(),
+		DurationSeconds: d.Seconds(),
+	})
+}
+
+// DetailSucceeded records that the page of a single asset was fetched.
+func (r *ReportRecorder) DetailSucceeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.DetailsAttempted++
+}
+
+// DetailFailed records that the page of a single asset could not be fetched
+// because of err.
+func (r *ReportRecorder) DetailFailed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.DetailsAttempted++
+	r.report.DetailsFailed++
+	r.report.DetailFailuresByKind[ErrorKind(err)]++
+}
+
+// ThumbProcessed records that the thumbnail of an asset was processed. reused
+// tells whether the result was taken over from an earlier crawl.
+func (r *ReportRecorder) ThumbProcessed(reused bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reused {
+		r.report.ThumbsReused++
+	} else {
+		r.report.ThumbsProcessed++
+	}
+}
+
+// ThumbFailed records that the thumbnail of an asset could not be processed
+// because of err.
+func (r *ReportRecorder) ThumbFailed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.ThumbsFailed++
+	r.report.ThumbFailuresByKind[ErrorKind(err)]++
+}
+
+// Progress returns the report so far, for following a running crawl. It
+// leaves out the lists of pages, which can get long, and does not run the
+// drift checks.
+func (r *ReportRecorder) Progress() models.CrawlReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	progress := r.report
+	progress.DurationSeconds = time.Since(progress.StartedAt).Seconds()
+	progress.FailuresByKind = maps.Clone(r.report.FailuresByKind)
+	progress.DetailFailuresByKind = maps.Clone(r.report.DetailFailuresByKind)
+	progress.ThumbFailuresByKind = maps.Clone(r.report.ThumbFailuresByKind)
+	progress.FillRatesBySource = maps.Clone(r.report.FillRatesBySource)
+	progress.Failures, progress.EmptyPages, progress.LowFillPages = nil, nil, nil
+	progress.DriftWarnings = slices.Clone(r.report.DriftWarnings)
+	progress.DriftFailures = slices.Clone(r.report.DriftFailures)
+	return progress
+}
+
+// Finish completes the report with the number of assets that came out of the
+// crawl and returns it.
+func (r *ReportRecorder) Finish(assetCount int) models.CrawlReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.FinishedAt = time.Now().UTC()
+	r.report.DurationSeconds = r.report.FinishedAt.Sub(r.report.StartedAt).Seconds()
+	r.report.AssetCount = int64(assetCount)
+	if r.report.PagesAttempted > 0 {
+		r.report.AvgPageSeconds = r.totalPageTime.Seconds() / float64(r.report.PagesAttempted)
+	}
+	slices.SortFunc(r.report.Failures, func(a, b models.PageFailure) int {
+		return comparePages(models.PageRef{Source: a.Source, Page: a.Page}, models.PageRef{Source: b.Source, Page: b.Page})
+	})
+	slices.SortFunc(r.report.EmptyPages, comparePages)
+	slices.SortFunc(r.report.LowFillPages, comparePages)
+
+	var total fillCounts
+	r.report.FillRatesBySource = make(map[string]models.FillRates, len(r.sources))
+	r.report.DriftWarnings, r.report.DriftFailures = nil, nil
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		s := r.sources[name]
+		total.addCounts(s.fill)
+		rates := s.fill.rates()
+		r.report.FillRatesBySource[name] = rates
+		warnings, failures := s.drift.CheckRun(rates, s.pages, s.emptyPages)
+		for _, warning := range warnings {
+			r.report.DriftWarnings = append(r.report.DriftWarnings, name+": "+warning)
+		}
+		for _, failure := range failures {
+			r.report.DriftFailures = append(r.report.DriftFailures, name+": "+failure)
+		}
+	}
+	r.report.FillRates = total.rates()
+
+	report := r.report
+	report.FailuresByKind = maps.Clone(r.report.FailuresByKind)
+	report.FillRatesBySource = maps.Clone(r.report.FillRatesBySource)
+	report.Failures = slices.Clone(r.report.Failures)
+	report.EmptyPages = slices.Clone(r.report.EmptyPages)
+	report.LowFillPages = slices.Clone(r.report.LowFillPages)
+	report.DetailFailuresByKind = maps.Clone(r.report.DetailFailuresByKind)
+	report.ThumbFailuresByKind = maps.Clone(r.report.ThumbFailuresByKind)
+	return report
+}
+
+// comparePages orders pages by source, then by page number.
+func comparePages(a, b models.PageRef) int {
+	if c := strings.Compare(a.Source, b.Source); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Page, b.Page)
+}
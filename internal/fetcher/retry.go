@@ -0,0 +1,148 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"itchgrep/internal/logging"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how often and how patiently a failed request is
+// retried. Network errors, 429 and 5xx responses are retried; any other
+// response is handed back to the caller as is.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration // scale of the exponential backoff
+	MaxDelay    time.Duration // upper bound of a single wait, including Retry-After
+	MaxElapsed  time.Duration // upper bound of the time spent retrying one request
+}
+
+// DefaultRetryPolicy is used for any Fetcher that does not specify its own.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 21,
+	BaseDelay:   1 * time.Second,
+	MaxDelay:    2 * time.Minute,
+	MaxElapsed:  15 * time.Minute,
+}
+
+// calculateBackoff calculates the delay for the next retry attempt using
+// exponential backoff with jitter.
+func calculateBackoff(attempt int, baseDelay time.Duration) time.Duration {
+	// Exponential backoff factor
+	expFactor := math.Pow(1.36, float64(attempt))
+	// Add jitter by introducing randomness
+	jitter := rand.Float64() * expFactor * float64(baseDelay)
+	return time.Duration(jitter)
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns false if the header is missing or
+// malformed.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// isRetryableStatus reports whether a response with the given status code is
+// worth another attempt.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// delay returns how long to wait before the next attempt. A Retry-After
+// header on resp takes precedence over the exponential backoff.
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	d := calculateBackoff(attempt, p.BaseDelay)
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			d = retryAfter
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// do sends a GET request to url and retries it according to the fetcher's
+// retry policy. The returned response is the first one that is not retried,
+// and the caller is responsible for closing its body. Bodies of retried
+// responses are closed here.
+func (f *Fetcher) do(ctx context.Context, url string) (*http.Response, error) {
+	start := time.Now()
+	var lastErr error
+	attempts := 0
+	for attempt := 0; attempt < f.retry.MaxAttempts; attempt++ {
+		attempts++
+		resp, err := f.get(ctx, url)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logging.Warning("Failed to fetch %s at attempt %d: %v", url, attempt, err)
+			lastErr = &NetworkError{URL: url, Err: err}
+		} else if isRetryableStatus(resp.StatusCode) {
+			logging.Warning("Got %s for %s at attempt %d, waiting and retrying", resp.Status, url, attempt)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				lastErr = &ThrottledError{URL: url}
+			} else {
+				lastErr = &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+			}
+			resp.Body.Close()
+		} else {
+			return resp, nil
+		}
+
+		if attempt == f.retry.MaxAttempts-1 {
+			break
+		}
+		wait := f.retry.delay(attempt, resp)
+		if f.retry.MaxElapsed > 0 && time.Since(start)+wait > f.retry.MaxElapsed {
+			logging.Warning("Retrying %s would exceed %v, giving up", url, f.retry.MaxElapsed)
+			break
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+
+	var throttled *ThrottledError
+	if errors.As(lastErr, &throttled) {
+		throttled.Attempts = attempts
+	}
+	return nil, lastErr
+}
+
+// sleepContext waits for the given duration, returning early with the
+// context's error if it is cancelled in the meantime.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
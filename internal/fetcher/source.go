@@ -0,0 +1,100 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"itchgrep/pkg/models"
+	"math"
+)
+
+// ItchSourceName is the name of the itch.io source. For compatibility with
+// snapshots from before there were sources, assets without a source belong
+// to it, and its GameIds are not prefixed.
+const ItchSourceName = "itch"
+
+// Source is a catalogue of assets that is crawled page by page. Every asset a
+// source returns has its Source set to the name of the source, and a GameId
+// that is unique across all sources.
+type Source interface {
+	// Name identifies the source in crawl reports, checkpoints and assets.
+	Name() string
+
+	// PageCount returns how many pages the catalogue currently has.
+	PageCount(ctx context.Context) (int64, error)
+
+	// FetchPage fetches and parses a single page, counting from 1. Pages
+	// are ordered by popularity where the catalogue allows it. The returned
+	// error is one of the typed errors of this package, or the context's
+	// error.
+	FetchPage(ctx context.Context, pageNum int64) ([]models.Asset, error)
+}
+
+// DetailSource is a Source that can fetch the details of its assets from a
+// page of their own, for the optional detail crawl stage.
+type DetailSource interface {
+	Source
+	FetchDetails(ctx context.Context, asset models.Asset) (AssetDetails, error)
+}
+
+// DriftThresholdsOf returns the thresholds the fill rates of a source are
+// checked against. Sources that do not provide every listing field
+// implement a DriftThresholds method, all others use DefaultDriftThresholds.
+func DriftThresholdsOf(source Source) DriftThresholds {
+	if s, ok := source.(interface{ DriftThresholds() DriftThresholds }); ok {
+		return s.DriftThresholds()
+	}
+	return DefaultDriftThresholds
+}
+
+// SourceOf returns the name of the source asset was crawled from.
+func SourceOf(asset models.Asset) string {
+	if asset.Source == "" {
+		return ItchSourceName
+	}
+	return asset.Source
+}
+
+// ItchSource crawls a listing of itch.io through a Fetcher.
+type ItchSource struct {
+	fetcher *Fetcher
+	listing string
+}
+
+// NewItchSource creates a source for a listing below the base URL of f, such
+// as "newest". The empty listing is the base URL itself.
+func NewItchSource(f *Fetcher, listing string) *ItchSource {
+	return &ItchSource{fetcher: f, listing: listing}
+}
+
+func (s *ItchSource) Name() string {
+	return ItchSourceName
+}
+
+func (s *ItchSource) PageCount(ctx context.Context) (int64, error) {
+	assetCount, err := s.fetcher.GetListingAssetCount(ctx, s.listing)
+	if err != nil {
+		return 0, err
+	}
+
+	// fetch the first page to get the number of items per page
+	respData, err := s.fetcher.FetchListingPage(ctx, s.listing, 1)
+	if err != nil {
+		return 0, err
+	}
+	if respData.NumItems <= 0 {
+		return 0, &ParseError{Page: 1, Err: fmt.Errorf("first page has %d items", respData.NumItems)}
+	}
+	return int64(math.Ceil(float64(assetCount) / float64(respData.NumItems))), nil
+}
+
+func (s *ItchSource) FetchPage(ctx context.Context, pageNum int64) ([]models.Asset, error) {
+	respData, err := s.fetcher.FetchListingPage(ctx, s.listing, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAssetPage(respData, pageNum) // we include pageNum, as it indicates popularity
+}
+
+func (s *ItchSource) FetchDetails(ctx context.Context, asset models.Asset) (AssetDetails, error) {
+	return s.fetcher.FetchAssetDetails(ctx, asset.Link)
+}
@@ -0,0 +1,163 @@
+package fetcher
+
+import (
+	"fmt"
+	"itchgrep/pkg/models"
+)
+
+// ComputeFillRates returns the share of assets that have each listing field
+// set.
+func ComputeFillRates(assets []models.Asset) models.FillRates {
+	counts := fillCounts{}
+	counts.add(assets)
+	return counts.rates()
+}
+
+// FillCounter computes the fill rates of assets that are seen a few at a
+// time, such as those of a crawl that is streamed into a snapshot. The zero
+// value is ready to use.
+type FillCounter struct {
+	counts fillCounts
+}
+
+// Add counts the given assets.
+func (c *FillCounter) Add(assets ...models.Asset) {
+	c.counts.add(assets)
+}
+
+// Rates returns the fill rates of all assets counted so far.
+func (c *FillCounter) Rates() models.FillRates {
+	return c.counts.rates()
+}
+
+// fillCounts are the absolute numbers behind models.FillRates, which can be
+// summed up page by page.
+type fillCounts struct {
+	assets, gameId, title, author, description, link, thumbUrl int64
+}
+
+func (c *fillCounts) add(assets []models.Asset) {
+	for _, asset := range assets {
+		c.assets++
+		if asset.GameId != "" {
+			c.gameId++
+		}
+		if asset.Title != "" {
+			c.title++
+		}
+		if asset.Author != "" {
+			c.author++
+		}
+		if asset.Description != "" {
+			c.description++
+		}
+		if asset.Link != "" {
+			c.link++
+		}
+		if asset.ThumbUrl != "" {
+			c.thumbUrl++
+		}
+	}
+}
+
+func (c *fillCounts) addCounts(other fillCounts) {
+	c.assets += other.assets
+	c.gameId += other.gameId
+	c.title += other.title
+	c.author += other.author
+	c.description += other.description
+	c.link += other.link
+	c.thumbUrl += other.thumbUrl
+}
+
+func (c fillCounts) rates() models.FillRates {
+	if c.assets == 0 {
+		return models.FillRates{}
+	}
+	n := float64(c.assets)
+	return models.FillRates{
+		Assets:      c.assets,
+		GameId:      float64(c.gameId) / n,
+		Title:       float64(c.title) / n,
+		Author:      float64(c.author) / n,
+		Description: float64(c.description) / n,
+		Link:        float64(c.link) / n,
+		ThumbUrl:    float64(c.thumbUrl) / n,
+	}
+}
+
+// DriftThresholds decide when the fill rates of a crawl look like the
+// listing markup changed under us. Falling below Warn is logged and noted in
+// the report, falling below Fail keeps the crawl from being published.
+// Descriptions are optional on itch.io, so they are never checked.
+type DriftThresholds struct {
+	Warn models.FillRates
+	Fail models.FillRates
+
+	// the share of successfully fetched pages that may contain no assets
+	// at all before the run fails
+	MaxEmptyPageShare float64
+}
+
+var DefaultDriftThresholds = DriftThresholds{
+	Warn: models.FillRates{
+		GameId:   1,
+		Title:    0.99,
+		Author:   0.98,
+		Link:     1,
+		ThumbUrl: 0.95,
+	},
+	Fail: models.FillRates{
+		GameId:   0.99,
+		Title:    0.95,
+		Author:   0.9,
+		Link:     0.99,
+		ThumbUrl: 0.8,
+	},
+	MaxEmptyPageShare: 0.02,
+}
+
+// below lists every checked field of rates that is lower than in min.
+func below(rates, min models.FillRates) []string {
+	var problems []string
+	check := func(field string, rate, minRate float64) {
+		if rate < minRate {
+			problems = append(problems, fmt.Sprintf("%s fill rate %.3f is below %.3f", field, rate, minRate))
+		}
+	}
+	check("GameId", rates.GameId, min.GameId)
+	check("Title", rates.Title, min.Title)
+	check("Author", rates.Author, min.Author)
+	check("Link", rates.Link, min.Link)
+	check("ThumbUrl", rates.ThumbUrl, min.ThumbUrl)
+	return problems
+}
+
+// CheckPage compares the fill rates of a single page against the warning
+// thresholds. Single pages are too small to fail a run on their own.
+func (t DriftThresholds) CheckPage(rates models.FillRates) []string {
+	if rates.Assets == 0 {
+		return []string{"page contains no assets"}
+	}
+	return below(rates, t.Warn)
+}
+
+// CheckRun compares the fill rates of a whole run against the thresholds.
+// pages is the number of successfully fetched pages, emptyPages how many of
+// them contained no assets.
+func (t DriftThresholds) CheckRun(rates models.FillRates, pages, emptyPages int64) (warnings, failures []string) {
+	if pages == 0 {
+		return nil, nil
+	}
+	if rates.Assets == 0 {
+		return nil, []string{"no assets were parsed from any page"}
+	}
+	failures = below(rates, t.Fail)
+	if emptyShare := float64(emptyPages) / float64(pages); emptyShare > t.MaxEmptyPageShare {
+		failures = append(failures, fmt.Sprintf("%d of %d pages contain no assets", emptyPages, pages))
+	}
+	if len(failures) == 0 {
+		warnings = below(rates, t.Warn)
+	}
+	return warnings, failures
+}
@@ -0,0 +1,112 @@
+// Package index defines how assets are laid out in the bleve index, which is
+// built by the dataservice and queried by the webserver's cache.
+package index
+
+import (
+	"fmt"
+	"itchgrep/pkg/models"
+	"slices"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+)
+
+// FieldFacets holds the itch.io listing facets an asset appeared under, such
+// as "free" or "tag-pixel-art". It is indexed as keywords, so it can only be
+// matched exactly.
+const FieldFacets = "Facets"
+
+// The price fields of models.IndexedAsset. PriceCents and DiscountPercent
+// are numeric, Currency is a keyword.
+const (
+	FieldFree            = "Free"
+	FieldPriceCents      = "PriceCents"
+	FieldCurrency        = "Currency"
+	FieldDiscountPercent = "DiscountPercent"
+)
+
+// FieldColorBins holds the bins of the dominant colours of an asset's
+// thumbnail, see ColorBins. It is indexed as keywords.
+const FieldColorBins = "ColorBins"
+
+// colorLevels is the number of levels per channel the RGB cube is divided
+// into for ColorBins.
+const colorLevels = 6
+
+// minBinShare is the share of a thumbnail a palette colour must cover to be
+// indexed, so that small details do not make an asset match every colour.
+const minBinShare = 0.1
+
+// colorBin names the bin of the RGB cube at the given levels, e.g. "c052".
+func colorBin(r, g, b int) string {
+	return fmt.Sprintf("c%d%d%d", r, g, b)
+}
+
+func colorLevel(value uint8) int {
+	return int(value) * colorLevels / 256
+}
+
+// ColorBins returns the bins of the colours of palette that cover enough of
+// the thumbnail. Colour distances can not be queried in the index, so the
+// RGB cube is divided into bins, and colours are compared by the distance
+// of their bins, see NearColorBins.
+func ColorBins(palette []models.Color) []string {
+	var bins []string
+	for _, color := range palette {
+		if color.Share < minBinShare {
+			continue
+		}
+		bin := colorBin(colorLevel(color.R), colorLevel(color.G), colorLevel(color.B))
+		if !slices.Contains(bins, bin) {
+			bins = append(bins, bin)
+		}
+	}
+	return bins
+}
+
+// NearColorBins returns the bin of color and its neighbours, with the
+// distance of each to the bin of color: 0 for the bin itself, up to 3 for
+// the neighbours that differ in every channel.
+func NearColorBins(color models.Color) map[string]int {
+	r, g, b := colorLevel(color.R), colorLevel(color.G), colorLevel(color.B)
+	bins := make(map[string]int)
+	for dr := -1; dr <= 1; dr++ {
+		for dg := -1; dg <= 1; dg++ {
+			for db := -1; db <= 1; db++ {
+				if !inLevels(r+dr) || !inLevels(g+dg) || !inLevels(b+db) {
+					continue
+				}
+				bins[colorBin(r+dr, g+dg, b+db)] = abs(dr) + abs(dg) + abs(db)
+			}
+		}
+	}
+	return bins
+}
+
+func inLevels(level int) bool {
+	return level >= 0 && level < colorLevels
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// NewMapping returns the mapping of models.IndexedAsset. Text fields are left
+// to the default mapping, the fields used for filtering are set up here.
+func NewMapping() mapping.IndexMapping {
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+
+	indexMapping := bleve.NewIndexMapping()
+	indexMapping.DefaultMapping.AddFieldMappingsAt(FieldFacets, keywordField)
+	indexMapping.DefaultMapping.AddFieldMappingsAt(FieldFree, bleve.NewBooleanFieldMapping())
+	indexMapping.DefaultMapping.AddFieldMappingsAt(FieldPriceCents, bleve.NewNumericFieldMapping())
+	indexMapping.DefaultMapping.AddFieldMappingsAt(FieldCurrency, keywordField)
+	indexMapping.DefaultMapping.AddFieldMappingsAt(FieldDiscountPercent, bleve.NewNumericFieldMapping())
+	indexMapping.DefaultMapping.AddFieldMappingsAt(FieldColorBins, keywordField)
+	return indexMapping
+}
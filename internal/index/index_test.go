@@ -0,0 +1,89 @@
+package index
+
+import (
+	"itchgrep/pkg/models"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFacetsAreMatchedExactly(t *testing.T) {
+	idx, err := bleve.NewMemOnly(NewMapping())
+	require.NoError(t, err)
+	defer idx.Close()
+
+	require.NoError(t, idx.Index("1", models.IndexedAsset{GameId: "1", Title: "Bones", Facets: []string{"free", "tag-pixel-art"}}))
+	require.NoError(t, idx.Index("2", models.IndexedAsset{GameId: "2", Title: "Pixel Art Bones", Facets: []string{"tag-pixel"}}))
+
+	facetQuery := bleve.NewTermQuery("tag-pixel-art")
+	facetQuery.SetField(FieldFacets)
+	result, err := idx.Search(bleve.NewSearchRequest(facetQuery))
+	require.NoError(t, err)
+	require.Len(t, result.Hits, 1)
+	assert.Equal(t, "1", result.Hits[0].ID)
+
+	// text fields are still analyzed
+	titleQuery := bleve.NewMatchQuery("bones")
+	titleQuery.SetField("Title")
+	result, err = idx.Search(bleve.NewSearchRequest(titleQuery))
+	require.NoError(t, err)
+	assert.Len(t, result.Hits, 2)
+}
+
+func TestPriceFieldsAreFilterable(t *testing.T) {
+	idx, err := bleve.NewMemOnly(NewMapping())
+	require.NoError(t, err)
+	defer idx.Close()
+
+	require.NoError(t, idx.Index("free", models.IndexedAsset{GameId: "free", Free: true}))
+	require.NoError(t, idx.Index("cheap", models.IndexedAsset{GameId: "cheap", PriceCents: 250, Currency: "USD", DiscountPercent: 50}))
+	require.NoError(t, idx.Index("pricey", models.IndexedAsset{GameId: "pricey", PriceCents: 2000, Currency: "USD"}))
+
+	search := func(q query.Query) []string {
+		request := bleve.NewSearchRequest(q)
+		request.SortBy([]string{"_id"})
+		result, err := idx.Search(request)
+		require.NoError(t, err)
+		var ids []string
+		for _, hit := range result.Hits {
+			ids = append(ids, hit.ID)
+		}
+		return ids
+	}
+
+	freeQuery := bleve.NewBoolFieldQuery(true)
+	freeQuery.SetField(FieldFree)
+	assert.Equal(t, []string{"free"}, search(freeQuery))
+
+	maxPrice, inclusive := 250.0, true
+	priceQuery := bleve.NewNumericRangeInclusiveQuery(nil, &maxPrice, nil, &inclusive)
+	priceQuery.SetField(FieldPriceCents)
+	assert.Equal(t, []string{"cheap", "free"}, search(priceQuery))
+
+	minDiscount := 1.0
+	saleQuery := bleve.NewNumericRangeQuery(&minDiscount, nil)
+	saleQuery.SetField(FieldDiscountPercent)
+	assert.Equal(t, []string{"cheap"}, search(saleQuery))
+}
+
+func TestColorBins(t *testing.T) {
+	palette := []models.Color{
+		{R: 40, G: 160, B: 60, Share: 0.6},
+		{R: 35, G: 165, B: 50, Share: 0.3}, // same bin
+		{R: 200, G: 30, B: 30, Share: 0.05},
+	}
+	bins := ColorBins(palette)
+	assert.Equal(t, []string{"c031"}, bins)
+
+	near := NearColorBins(models.Color{R: 50, G: 150, B: 100})
+	assert.Equal(t, 0, near["c132"])
+	assert.Equal(t, 2, near["c031"]) // one level apart in red and blue
+	assert.NotContains(t, near, "c030")
+	assert.Len(t, near, 27)
+
+	// bins at the edge of the cube have fewer neighbours
+	assert.Len(t, NearColorBins(models.Color{}), 8)
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"itchgrep/pkg/models"
+	"path"
+	"slices"
+	"strings"
+)
+
+// CheckpointPrefix is the directory in the bucket that holds the checkpoints
+// of unfinished crawls, one file per run. The assets a run has written so far
+// are kept in a directory of the same name, in parts.
+const CheckpointPrefix = "checkpoints/"
+
+func checkpointName(runId string) string {
+	return CheckpointPrefix + runId + ".json"
+}
+
+func checkpointPartName(runId string, part int) string {
+	return fmt.Sprintf("%s%s/assets-%04d.json", CheckpointPrefix, runId, part)
+}
+
+// PutCheckpoint stores the progress of an unfinished crawl, replacing any
+// earlier checkpoint of the same run.
+func PutCheckpoint(ctx context.Context, checkpoint models.CrawlCheckpoint) error {
+	return putJSON(ctx, checkpointName(checkpoint.RunId), checkpoint)
+}
+
+// GetCheckpoint fetches the stored progress of the given run.
+func GetCheckpoint(ctx context.Context, runId string) (models.CrawlCheckpoint, error) {
+	var checkpoint models.CrawlCheckpoint
+	err := getJSON(ctx, checkpointName(runId), &checkpoint)
+	return checkpoint, err
+}
+
+// ListCheckpoints returns the IDs of all runs that left a checkpoint behind,
+// sorted in ascending order.
+func ListCheckpoints(ctx context.Context) ([]string, error) {
+	names, err := listObjects(ctx, CheckpointPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var runIds []string
+	for _, name := range names {
+		// the parts of the assets are in a directory per run
+		if strings.HasSuffix(name, ".json") && !strings.Contains(strings.TrimPrefix(name, CheckpointPrefix), "/") {
+			runIds = append(runIds, strings.TrimSuffix(path.Base(name), ".json"))
+		}
+	}
+	slices.Sort(runIds)
+	return runIds, nil
+}
+
+// PutCheckpointAssetsFile stores the local JSON file at filePath, which holds
+// an array of assets, as the given part of the assets of an unfinished crawl.
+func PutCheckpointAssetsFile(ctx context.Context, runId string, part int, filePath string) error {
+	return putFile(ctx, checkpointPartName(runId, part), "application/json", filePath)
+}
+
+// EachCheckpointAsset decodes the given part of the assets of an unfinished
+// crawl one at a time and calls fn for each of them, like EachAsset.
+func EachCheckpointAsset(ctx context.Context, runId string, part int, fn func(models.Asset) error) error {
+	return eachAssetIn(ctx, checkpointPartName(runId, part), fn)
+}
+
+// DeleteCheckpoint removes the checkpoint of the given run and the parts of
+// its assets, once it finished or is abandoned. The checkpoint goes first, so
+// that a failure never leaves one behind that is missing parts.
+func DeleteCheckpoint(ctx context.Context, runId string) error {
+	if err := deleteObject(ctx, checkpointName(runId)); err != nil {
+		return err
+	}
+	names, err := listObjects(ctx, CheckpointPrefix+runId+"/")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := deleteObject(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"itchgrep/internal/logging"
+)
+
+// UseDir makes the storage functions read and write the files of a local
+// directory instead of the bucket, for running without any cloud services.
+// It must be called before any object is accessed.
+func UseDir(dir string) {
+	logging.Info("Using storage directory %s", dir)
+	store = dirBackend{dir: dir}
+}
+
+// dirBackend stores every object as a file below dir. Content types are
+// derived from the file extensions.
+type dirBackend struct {
+	dir string
+}
+
+// path returns the file of the named object, refusing names that would
+// leave the directory.
+func (b dirBackend) path(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(b.dir, filepath.FromSlash(name)), nil
+}
+
+func (b dirBackend) put(ctx context.Context, name, contentType string, r io.Reader) error {
+	file, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	// written next to the target first, so that readers never see half a
+	// file, under a name of its own, since the same object can be put
+	// concurrently, e.g. a thumbnail shared by two assets
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (b dirBackend) open(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	file, err := b.path(name)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return f, mime.TypeByExtension(path.Ext(name)), nil
+}
+
+func (b dirBackend) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(b.dir, func(file string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // nothing was stored yet
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(b.dir, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, ".tmp") {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (b dirBackend) delete(ctx context.Context, name string) error {
+	file, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// remove the directories left empty, which fails at the first one that
+	// is not
+	for dir := filepath.Dir(file); dir != filepath.Clean(b.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
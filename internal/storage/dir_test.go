@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"itchgrep/pkg/models"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirBackend(t *testing.T) {
+	previous := store
+	defer func() { store = previous }()
+	dir := t.TempDir()
+	UseDir(dir)
+	ctx := context.Background()
+
+	_, err := GetManifest(ctx)
+	assert.ErrorIs(t, err, ErrNotFound)
+	runIds, err := ListCheckpoints(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, runIds)
+
+	assets := []models.Asset{{GameId: "1", Title: "Asset 1"}}
+	require.NoError(t, PutAssets(ctx, "run-1", assets))
+	stored, err := GetAssets(ctx, "run-1")
+	require.NoError(t, err)
+	assert.Equal(t, assets, stored)
+	assert.FileExists(t, filepath.Join(dir, "snapshots", "run-1", DataFileName))
+	_, err = GetAssets(ctx, "run-2")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// assets can be stored from a file and read one at a time
+	file := filepath.Join(t.TempDir(), DataFileName)
+	require.NoError(t, os.WriteFile(file, []byte(`[{"GameId":"1"},{"GameId":"2"}]`), 0o644))
+	require.NoError(t, PutAssetsFile(ctx, "run-2", file))
+	var gameIds []string
+	require.NoError(t, EachAsset(ctx, "run-2", func(asset models.Asset) error {
+		gameIds = append(gameIds, asset.GameId)
+		return nil
+	}))
+	assert.Equal(t, []string{"1", "2"}, gameIds)
+	assert.ErrorIs(t, EachAsset(ctx, "run-3", func(models.Asset) error { return nil }), ErrNotFound)
+
+	manifest := models.Manifest{SnapshotId: "run-1", PublishedAt: time.Now().UTC(), AssetCount: 1}
+	require.NoError(t, PutManifest(ctx, manifest))
+	current, err := GetManifest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.SnapshotId, current.SnapshotId)
+	assert.True(t, manifest.PublishedAt.Equal(current.PublishedAt))
+
+	require.NoError(t, PutCheckpoint(ctx, models.CrawlCheckpoint{RunId: "b"}))
+	require.NoError(t, PutCheckpoint(ctx, models.CrawlCheckpoint{RunId: "a"}))
+	runIds, err = ListCheckpoints(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, runIds)
+	require.NoError(t, PutCheckpointAssetsFile(ctx, "a", 0, file))
+	runIds, err = ListCheckpoints(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, runIds, "the parts of the assets are not checkpoints")
+	gameIds = nil
+	require.NoError(t, EachCheckpointAsset(ctx, "a", 0, func(asset models.Asset) error {
+		gameIds = append(gameIds, asset.GameId)
+		return nil
+	}))
+	assert.Equal(t, []string{"1", "2"}, gameIds)
+	require.NoError(t, DeleteCheckpoint(ctx, "a"))
+	require.NoError(t, DeleteCheckpoint(ctx, "a"), "deleting twice is not an error")
+	assert.NoDirExists(t, filepath.Join(dir, "checkpoints", "a"), "the parts are deleted too")
+
+	require.NoError(t, PutThumb(ctx, "abc-315.webp", "image/webp", []byte("webp")))
+	data, contentType, err := GetThumb(ctx, "abc-315.webp")
+	require.NoError(t, err)
+	assert.Equal(t, "webp", string(data))
+	assert.Equal(t, "image/webp", contentType)
+	_, _, err = GetThumb(ctx, "../../etc/passwd")
+	assert.Error(t, err)
+
+	// the index round trips through an archive
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, os.MkdirAll(IndexDirName, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(IndexDirName, "store"), []byte("index"), 0o644))
+	require.NoError(t, PutIndex(ctx, "run-1", IndexDirName))
+	require.NoError(t, os.RemoveAll(IndexDirName))
+	indexPath, err := GetIndex(ctx, "run-1", ".")
+	require.NoError(t, err)
+	data, err = os.ReadFile(filepath.Join(indexPath, "store"))
+	require.NoError(t, err)
+	assert.Equal(t, "index", string(data))
+}
+
+func TestDirBackendConcurrentPuts(t *testing.T) {
+	previous := store
+	defer func() { store = previous }()
+	dir := t.TempDir()
+	UseDir(dir)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, PutThumb(ctx, "abc-315.webp", "image/webp", []byte("webp")))
+		}()
+	}
+	wg.Wait()
+
+	data, _, err := GetThumb(ctx, "abc-315.webp")
+	require.NoError(t, err)
+	assert.Equal(t, "webp", string(data))
+	leftovers, err := filepath.Glob(filepath.Join(dir, "thumbs", "*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"itchgrep/pkg/models"
+	"slices"
+	"strings"
+)
+
+// SnapshotPrefix is the directory in the bucket that holds the published
+// snapshots, one directory per run with its assets, index and crawl report.
+// Snapshots are never modified once written.
+const SnapshotPrefix = "snapshots/"
+
+// ManifestFileName is the object that names the current snapshot.
+const ManifestFileName = "manifest.json"
+
+// snapshotObject returns the name of an object of the given snapshot.
+func snapshotObject(snapshotId, name string) string {
+	return SnapshotPrefix + snapshotId + "/" + name
+}
+
+// PutManifest makes the snapshot named in manifest the current one. The
+// manifest is a single object, so readers switch over to the new snapshot
+// at once.
+func PutManifest(ctx context.Context, manifest models.Manifest) error {
+	return putJSON(ctx, ManifestFileName, manifest)
+}
+
+// GetManifest fetches the manifest of the current snapshot. It returns
+// ErrNotFound if nothing was published yet.
+func GetManifest(ctx context.Context) (models.Manifest, error) {
+	var manifest models.Manifest
+	err := getJSON(ctx, ManifestFileName, &manifest)
+	return manifest, err
+}
+
+// PutChanges stores what changed since the previous snapshot next to the
+// given one.
+func PutChanges(ctx context.Context, snapshotId string, changes models.Changes) error {
+	return putJSON(ctx, snapshotObject(snapshotId, ChangesFileName), changes)
+}
+
+// GetChanges fetches what changed in the given snapshot. It returns
+// ErrNotFound for snapshots that had nothing to compare to.
+func GetChanges(ctx context.Context, snapshotId string) (models.Changes, error) {
+	var changes models.Changes
+	err := getJSON(ctx, snapshotObject(snapshotId, ChangesFileName), &changes)
+	return changes, err
+}
+
+// ListSnapshots returns the IDs of all stored snapshots, including those
+// whose upload never finished, sorted in ascending order.
+func ListSnapshots(ctx context.Context) ([]string, error) {
+	names, err := listObjects(ctx, SnapshotPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var snapshotIds []string
+	for _, name := range names {
+		snapshotId, _, ok := strings.Cut(strings.TrimPrefix(name, SnapshotPrefix), "/")
+		if ok && !slices.Contains(snapshotIds, snapshotId) {
+			snapshotIds = append(snapshotIds, snapshotId)
+		}
+	}
+	slices.Sort(snapshotIds)
+	return snapshotIds, nil
+}
+
+// DeleteSnapshot removes every object of the given snapshot.
+func DeleteSnapshot(ctx context.Context, snapshotId string) error {
+	names, err := listObjects(ctx, SnapshotPrefix+snapshotId+"/")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := deleteObject(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,18 +1,21 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"itchgrep/internal/logging"
 	"itchgrep/pkg/models"
 	"os"
 	"path/filepath"
-	"time"
+	"sync"
 
 	"cloud.google.com/go/storage"
 	"github.com/mholt/archiver/v4"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -21,8 +24,13 @@ const (
 	DataFileName     = "assets.json"
 	IndexDirName     = "index.bleve"
 	IndexArchiveName = "index.bleve.gz.tar"
+	ReportFileName   = "crawl_report.json"
+	ChangesFileName  = "changes.json"
 )
 
+// ErrNotFound is returned when a requested object is not in the bucket.
+var ErrNotFound = errors.New("object not found")
+
 var ArchiveFormat = archiver.CompressedArchive{
 	Compression: archiver.Gz{},
 	Archival:    archiver.Tar{},
@@ -30,179 +38,315 @@ var ArchiveFormat = archiver.CompressedArchive{
 
 func createClient(ctx context.Context) (*storage.Client, error) {
 	local := os.Getenv("RUN_LOCAL") == "true"
-	logging.Info("RUN_LOCAL: %v", local)
 	test := os.Getenv("RUN_TEST") == "true"
-	logging.Info("RUN_TEST: %v", test)
 
 	if local {
-		if !test {
-			os.Setenv("STORAGE_EMULATOR_HOST", "http://fake-gcs-server:4443") // name of the docker container
-			logging.Info("Using address: http://fake-gcs-server:4443")
-			return storage.NewClient(
-				ctx,
-				option.WithEndpoint("http://fake-gcs-server:4443/storage/v1/"),
-				storage.WithJSONReads())
-		} else { // if we are running tests, this is not running in a container
-			os.Setenv("STORAGE_EMULATOR_HOST", "http://localhost:4443")
-			logging.Info("Using address: http://localhost:4443")
-			return storage.NewClient(
-				ctx,
-				option.WithEndpoint("http://localhost:4443/storage/v1/"),
-				storage.WithJSONReads())
+		address := "http://fake-gcs-server:4443" // name of the docker container
+		if test {                                // if we are running tests, this is not running in a container
+			address = "http://localhost:4443"
 		}
+		logging.Info("RUN_LOCAL: %v", local)
+		logging.Info("RUN_TEST: %v", test)
+		logging.Info("Using address: %s", address)
+		os.Setenv("STORAGE_EMULATOR_HOST", address)
+		return storage.NewClient(
+			ctx,
+			option.WithEndpoint(address+"/storage/v1/"),
+			storage.WithJSONReads())
 	} else {
+		logging.Info("RUN_LOCAL: %v", local)
 		logging.Info("Using production GCS client.")
 		return storage.NewClient(ctx)
 	}
 }
 
-// PutAssets writes the provided assets to a Google Cloud Storage bucket as a JSON file.
-func PutAssets(assets []models.Asset) error {
-	ctx := context.Background()
+// backend stores the objects of the service under slash separated names.
+type backend interface {
+	put(ctx context.Context, name, contentType string, r io.Reader) error
+	open(ctx context.Context, name string) (io.ReadCloser, string, error)
+	list(ctx context.Context, prefix string) ([]string, error)
+	delete(ctx context.Context, name string) error
+}
+
+// store is the Google Cloud Storage bucket, unless UseDir was called.
+var store backend = &gcsBackend{}
+
+// gcsBackend stores objects in the Google Cloud Storage bucket, or in the
+// emulator when RUN_LOCAL is set. All objects are accessed through one
+// client, which is created on first use and safe for concurrent use.
+type gcsBackend struct {
+	mu     sync.Mutex
+	client *storage.Client
+}
+
+// bucket returns the bucket, creating the client if there is none yet. A
+// failure is not kept, the next call tries again.
+func (b *gcsBackend) bucket() (*storage.BucketHandle, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == nil {
+		// the client outlives the context of any single request
+		client, err := createClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("storage.NewClient: %v", err)
+		}
+		b.client = client
+	}
+	return b.client.Bucket(BucketName), nil
+}
+
+// putObject writes data to the store under the given name.
+func putObject(ctx context.Context, name, contentType string, data []byte) error {
+	return store.put(ctx, name, contentType, bytes.NewReader(data))
+}
+
+// putFile copies the local file at filePath to the store under the given
+// name, without reading it into memory.
+func putFile(ctx context.Context, name, contentType, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.put(ctx, name, contentType, f)
+}
 
-	client, err := createClient(ctx)
+// getObject reads the named object and its content type from the store,
+// returning ErrNotFound if there is none.
+func getObject(ctx context.Context, name string) ([]byte, string, error) {
+	r, contentType, err := store.open(ctx, name)
 	if err != nil {
-		return fmt.Errorf("storage.NewClient: %v", err)
+		return nil, "", err
 	}
-	defer client.Close()
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("io.ReadAll: %v", err)
+	}
+	return data, contentType, nil
+}
 
-	bkt := client.Bucket(BucketName)
+// listObjects returns the names of all objects in the store that start with
+// prefix.
+func listObjects(ctx context.Context, prefix string) ([]string, error) {
+	return store.list(ctx, prefix)
+}
 
-	// Convert assets slice to JSON
-	assetsJSON, err := json.Marshal(assets)
+// deleteObject removes the named object from the store. Deleting an object
+// that does not exist is not an error.
+func deleteObject(ctx context.Context, name string) error {
+	return store.delete(ctx, name)
+}
+
+// putJSON marshals v and writes it to the store under the given name.
+func putJSON(ctx context.Context, name string, v any) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return fmt.Errorf("json.Marshal: %v", err)
 	}
+	return putObject(ctx, name, "application/json", data)
+}
+
+// getJSON reads the named JSON file from the store and unmarshals it into v.
+func getJSON(ctx context.Context, name string, v any) error {
+	data, _, err := getObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("json.Unmarshal: %v", err)
+	}
+	return nil
+}
+
+func (b *gcsBackend) put(ctx context.Context, name, contentType string, r io.Reader) error {
+	bucket, err := b.bucket()
+	if err != nil {
+		return err
+	}
 
-	// Create a new writer to write the JSON data
-	obj := bkt.Object(DataFileName)
-	w := obj.NewWriter(ctx)
-	if _, err := w.Write(assetsJSON); err != nil {
+	w := bucket.Object(name).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
 		return fmt.Errorf("Writer.Write: %v", err)
 	}
 	if err := w.Close(); err != nil {
 		return fmt.Errorf("Writer.Close: %v", err)
 	}
-
 	return nil
 }
 
-// GetAssets fetches the assets JSON file from the Google Cloud Storage bucket and unmarshals it into a slice of Assets.
-func GetAssets() ([]models.Asset, error) {
-	ctx := context.Background()
-	client, err := createClient(ctx)
+func (b *gcsBackend) open(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	bucket, err := b.bucket()
 	if err != nil {
-		return nil, fmt.Errorf("storage.NewClient: %v", err)
+		return nil, "", err
 	}
-	defer client.Close()
 
-	bkt := client.Bucket(BucketName)
-	obj := bkt.Object(DataFileName)
-	r, err := obj.NewReader(ctx)
+	r, err := bucket.Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, "", ErrNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Object.NewReader: %v", err)
+		return nil, "", fmt.Errorf("Object.NewReader: %v", err)
 	}
-	defer r.Close()
+	return r, r.Attrs.ContentType, nil
+}
 
-	data, err := io.ReadAll(r)
+func (b *gcsBackend) list(ctx context.Context, prefix string) ([]string, error) {
+	bucket, err := b.bucket()
 	if err != nil {
-		return nil, fmt.Errorf("io.ReadAll: %v", err)
+		return nil, err
 	}
 
-	var assets []models.Asset
-	if err := json.Unmarshal(data, &assets); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %v", err)
+	var names []string
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bucket.Objects: %v", err)
+		}
+		names = append(names, attrs.Name)
+	}
+	return names, nil
+}
+
+func (b *gcsBackend) delete(ctx context.Context, name string) error {
+	bucket, err := b.bucket()
+	if err != nil {
+		return err
+	}
+
+	err = bucket.Object(name).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("Object.Delete: %v", err)
 	}
+	return nil
+}
 
+// PutAssets writes the provided assets to the given snapshot as a JSON file.
+func PutAssets(ctx context.Context, snapshotId string, assets []models.Asset) error {
+	return putJSON(ctx, snapshotObject(snapshotId, DataFileName), assets)
+}
+
+// PutAssetsFile stores the local JSON file at filePath, which holds an array
+// of assets, as the assets of the given snapshot.
+func PutAssetsFile(ctx context.Context, snapshotId, filePath string) error {
+	return putFile(ctx, snapshotObject(snapshotId, DataFileName), "application/json", filePath)
+}
+
+// GetAssets fetches the assets JSON file of the given snapshot and unmarshals
+// it into a slice of Assets.
+func GetAssets(ctx context.Context, snapshotId string) ([]models.Asset, error) {
+	var assets []models.Asset
+	if err := getJSON(ctx, snapshotObject(snapshotId, DataFileName), &assets); err != nil {
+		return nil, err
+	}
 	return assets, nil
 }
 
-func GetAssetsUpdateTime() (time.Time, error) {
-	ctx := context.Background()
-	client, err := createClient(ctx)
+// EachAsset decodes the assets of the given snapshot one at a time and calls
+// fn for each of them, without holding all of them in memory. It stops at
+// the first error fn returns.
+func EachAsset(ctx context.Context, snapshotId string, fn func(models.Asset) error) error {
+	return eachAssetIn(ctx, snapshotObject(snapshotId, DataFileName), fn)
+}
+
+// eachAssetIn decodes the named JSON array of assets one at a time and calls
+// fn for each of them.
+func eachAssetIn(ctx context.Context, name string, fn func(models.Asset) error) error {
+	r, _, err := store.open(ctx, name)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("storage.NewClient: %v", err)
+		return err
 	}
-	defer client.Close()
+	defer r.Close()
 
-	bkt := client.Bucket(BucketName)
-	objAttrs, err := bkt.Object(DataFileName).Attrs(ctx)
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
 	if err != nil {
-		return time.Time{}, fmt.Errorf("Object.Attrs: %v", err)
+		return fmt.Errorf("json.Decoder.Token: %v", err)
+	}
+	if token == nil {
+		return nil // the assets of an empty snapshot may be stored as null
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected an array of assets, got %v", token)
 	}
+	for decoder.More() {
+		var asset models.Asset
+		if err := decoder.Decode(&asset); err != nil {
+			return fmt.Errorf("json.Decoder.Decode: %v", err)
+		}
+		if err := fn(asset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return objAttrs.Updated, nil
+// PutCrawlReport stores the report of the crawl that produced a snapshot next
+// to its assets.
+func PutCrawlReport(ctx context.Context, snapshotId string, report models.CrawlReport) error {
+	return putJSON(ctx, snapshotObject(snapshotId, ReportFileName), report)
 }
 
-// PutFS writes the provided directory or file to a Google Cloud Storage
-// bucket as a compressed archive.
-func PutFS(dirPath, nameInStorage string) error {
-	ctx := context.Background()
+// GetCrawlReport fetches the report of the crawl that produced a snapshot.
+func GetCrawlReport(ctx context.Context, snapshotId string) (models.CrawlReport, error) {
+	var report models.CrawlReport
+	err := getJSON(ctx, snapshotObject(snapshotId, ReportFileName), &report)
+	return report, err
+}
 
-	client, err := createClient(ctx)
-	if err != nil {
-		return fmt.Errorf("storage.NewClient: %v", err)
-	}
-	defer client.Close()
+// PutIndex stores the index directory at dirPath in the given snapshot.
+func PutIndex(ctx context.Context, snapshotId, dirPath string) error {
+	return PutFS(ctx, dirPath, snapshotObject(snapshotId, IndexArchiveName))
+}
 
-	bkt := client.Bucket(BucketName)
+// GetIndex extracts the index of the given snapshot to targetPath and returns
+// the path of the index directory.
+func GetIndex(ctx context.Context, snapshotId, targetPath string) (string, error) {
+	return GetFS(ctx, snapshotObject(snapshotId, IndexArchiveName), targetPath)
+}
 
+// PutFS writes the provided directory or file to the store as a compressed
+// archive.
+func PutFS(ctx context.Context, dirPath, nameInStorage string) error {
 	// COMPRESSING INDEX DIRECTORY
 	fileMapping, _ := archiver.FilesFromDisk(nil, map[string]string{
 		dirPath: filepath.Base(dirPath),
 	})
 
-	// create temp dir for the archive file to be created in
-	archiveFileHandle, err := os.Create(nameInStorage)
+	// the archive is built in a temporary file, since the name in storage
+	// need not be a valid local path
+	archiveFileHandle, err := os.CreateTemp("", "archive-*.gz.tar")
 	if err != nil {
-		return fmt.Errorf("os.Create: %v", err)
+		return fmt.Errorf("os.CreateTemp: %v", err)
 	}
-	defer os.RemoveAll(nameInStorage)
+	defer os.Remove(archiveFileHandle.Name())
 
-	err = ArchiveFormat.Archive(context.Background(), archiveFileHandle, fileMapping)
+	err = ArchiveFormat.Archive(ctx, archiveFileHandle, fileMapping)
+	archiveFileHandle.Close()
 	if err != nil {
 		return fmt.Errorf("format.Archive: %v", err)
 	}
-	archiveFileHandle.Close()
 
-	// load zip file as bytes
-	archiveBytes, err := os.ReadFile(nameInStorage)
-	if err != nil {
-		return fmt.Errorf("zipFile.Read: %v", err)
+	if info, err := os.Stat(archiveFileHandle.Name()); err == nil {
+		logging.Debug("Archive size: %d", info.Size())
 	}
-
-	logging.Debug("Archive size: %d", len(archiveBytes))
-
-	// Create a new writer to write the index zip file
-	obj := bkt.Object(nameInStorage)
-	w := obj.NewWriter(ctx)
-	if _, err := w.Write(archiveBytes); err != nil {
-		return fmt.Errorf("Writer.Write: %v", err)
-	}
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("Writer.Close: %v", err)
-	}
-
-	return nil
+	return putFile(ctx, nameInStorage, "application/gzip", archiveFileHandle.Name())
 }
 
-// GetFS fetches the directory from the Google Cloud Storage bucket and
-// extracts it to the local filesystem. It returns the path of the file or
+// GetFS fetches the directory from the store and extracts it to the local
+// filesystem. It returns the path of the file or
 // directory in the archive.
 // Returns an empty string if the archive is empty.
-func GetFS(nameInStorage, targetPath string) (string, error) {
-	ctx := context.Background()
-	client, err := createClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("storage.NewClient: %v", err)
-	}
-	defer client.Close()
-
-	bkt := client.Bucket(BucketName)
-	obj := bkt.Object(nameInStorage)
-	r, err := obj.NewReader(ctx)
+func GetFS(ctx context.Context, nameInStorage, targetPath string) (string, error) {
+	r, _, err := store.open(ctx, nameInStorage)
 	if err != nil {
-		return "", fmt.Errorf("Object.NewReader: %v", err)
+		return "", err
 	}
 	defer r.Close()
 
@@ -211,7 +355,7 @@ func GetFS(nameInStorage, targetPath string) (string, error) {
 	rootDir := ""
 	rootFile := ""
 	// nil as the third argument to Extract means that all files will be extracted
-	err = ArchiveFormat.Extract(context.Background(), r, nil, func(ctx context.Context, file archiver.File) error {
+	err = ArchiveFormat.Extract(ctx, r, nil, func(ctx context.Context, file archiver.File) error {
 		rel := filepath.Clean(file.NameInArchive)
 		abs := filepath.Join(targetPath, rel)
 
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"crypto/rand"
 	"itchgrep/pkg/models"
 	"os"
@@ -21,42 +22,31 @@ func TestPutAndGetAssets(t *testing.T) {
 	}
 
 	// Test PutAssets
-	err := PutAssets(testAssets)
+	err := PutAssets(context.Background(), "test-snapshot", testAssets)
 	require.NoError(t, err, "PutAssets should not fail")
 
 	// Test GetAssets
-	retrievedAssets, err := GetAssets()
+	retrievedAssets, err := GetAssets(context.Background(), "test-snapshot")
 	require.NoError(t, err, "GetAssets should not fail")
 
 	// Verify that the retrieved assets match the original test assets
 	assert.Equal(t, testAssets, retrievedAssets, "Retrieved assets should match the original test assets")
 }
 
-func TestGetAssetsUpdateTime(t *testing.T) {
+func TestPutAndGetManifest(t *testing.T) {
 	os.Setenv("RUN_LOCAL", "true")
 
-	// Define a slice of Asset for testing
-	testAssets := []models.Asset{
-		{GameId: "1", Title: "Asset 1", Author: "Author 1", Description: "Description 1", Link: "http://example.com/1", ThumbUrl: "http://example.com/thumb1.jpg"},
-		{GameId: "2", Title: "Asset 2", Author: "Author 2", Description: "Description 2", Link: "http://example.com/2", ThumbUrl: "http://example.com/thumb2.jpg"},
-	}
-
-	timePrePut := time.Now()
-	time.Sleep(1 * time.Second)
-
-	// Put Assets
-	err := PutAssets(testAssets)
-	require.NoError(t, err, "PutAssets should not fail")
+	manifest := models.Manifest{SnapshotId: "test-snapshot", PublishedAt: time.Now().UTC().Truncate(time.Second), AssetCount: 2}
 
-	time.Sleep(1 * time.Second)
-	timePostPut := time.Now()
+	// Test PutManifest
+	err := PutManifest(context.Background(), manifest)
+	require.NoError(t, err, "PutManifest should not fail")
 
-	// Test GetAssetsUpdateTime
-	updateTime, err := GetAssetsUpdateTime()
-	require.NoError(t, err, "GetAssetsUpdateTime should not fail")
+	// Test GetManifest
+	retrievedManifest, err := GetManifest(context.Background())
+	require.NoError(t, err, "GetManifest should not fail")
 
-	assert.True(t, timePrePut.Before(updateTime), "Update time should be after the time of PutAssets")
-	assert.True(t, timePostPut.After(updateTime), "Update time should be before the time of GetAssetsUpdateTime")
+	assert.Equal(t, manifest, retrievedManifest, "Retrieved manifest should match the original manifest")
 }
 
 func TestPutAndGetFSWithSingleEmptyDirectory(t *testing.T) {
@@ -65,7 +55,7 @@ func TestPutAndGetFSWithSingleEmptyDirectory(t *testing.T) {
 	nameInStorage := "testDirInStorage.gz.tar"
 
 	testDir := t.TempDir()
-	err := PutFS(testDir, nameInStorage)
+	err := PutFS(context.Background(), testDir, nameInStorage)
 	require.NoError(t, err, "PutFS should not fail")
 
 	err = os.RemoveAll(testDir)
@@ -73,7 +63,7 @@ func TestPutAndGetFSWithSingleEmptyDirectory(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	outPath, err := GetFS(nameInStorage, ".")
+	outPath, err := GetFS(context.Background(), nameInStorage, ".")
 	require.NoError(t, err, "GetFS should not fail")
 
 	assert.DirExists(t, outPath, "Retrieved directory should exist")
@@ -107,7 +97,7 @@ func TestPutAndGetFSWithDirectoryContainingFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = PutFS(testDir, nameInStorage)
+	err = PutFS(context.Background(), testDir, nameInStorage)
 	require.NoError(t, err, "PutFS should not fail")
 
 	err = os.RemoveAll(testDir)
@@ -115,7 +105,7 @@ func TestPutAndGetFSWithDirectoryContainingFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	outPath, err := GetFS(nameInStorage, ".")
+	outPath, err := GetFS(context.Background(), nameInStorage, ".")
 	t.Cleanup(func() { os.RemoveAll(outPath) })
 	require.NoError(t, err, "GetFS should not fail")
 
@@ -141,10 +131,10 @@ func TestPutAndGetFSWithMissingFile(t *testing.T) {
 
 	nameInStorage := "testDirInStorage.gz.tar"
 
-	err := PutFS("some/path/to/a/nonexistent/file", nameInStorage)
+	err := PutFS(context.Background(), "some/path/to/a/nonexistent/file", nameInStorage)
 	require.NoError(t, err, "PutFS should not fail")
 
-	outPath, err := GetFS(nameInStorage, ".") // this should simply not extract any files
+	outPath, err := GetFS(context.Background(), nameInStorage, ".") // this should simply not extract any files
 	require.NoError(t, err, "GetFS should not fail")
 
 	assert.Equal(t, "", outPath, "Retrieved path should be empty")
@@ -0,0 +1,19 @@
+package storage
+
+import "context"
+
+// ThumbPrefix is the directory in the bucket that holds the mirrored
+// thumbnails. Their names are derived from their content, so they never
+// change once written.
+const ThumbPrefix = "thumbs/"
+
+// PutThumb stores a single thumbnail variant under name.
+func PutThumb(ctx context.Context, name, contentType string, data []byte) error {
+	return putObject(ctx, ThumbPrefix+name, contentType, data)
+}
+
+// GetThumb fetches a thumbnail variant and its content type. It returns
+// ErrNotFound if there is no thumbnail with that name.
+func GetThumb(ctx context.Context, name string) ([]byte, string, error) {
+	return getObject(ctx, ThumbPrefix+name)
+}
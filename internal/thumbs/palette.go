@@ -0,0 +1,129 @@
+package thumbs
+
+import (
+	"image"
+	"itchgrep/pkg/models"
+	"slices"
+
+	"golang.org/x/image/draw"
+)
+
+// PaletteSize is the largest number of colours Palette returns.
+const PaletteSize = 5
+
+// paletteSampleSize is the size thumbnails are shrunk to before their
+// colours are counted, which is plenty to find the dominant ones.
+const paletteSampleSize = 64
+
+// minPaletteDistance is the smallest squared RGB distance between two
+// colours of a palette, so that a gradient does not fill the whole palette
+// with shades of the same colour.
+const minPaletteDistance = 48 * 48
+
+// Palette extracts the dominant colours of img, the most common first.
+// Colours are found in a histogram of the thumbnail, then refined by
+// assigning every pixel to the nearest of them. Transparent pixels are
+// ignored, so a fully transparent image has no palette.
+func Palette(img image.Image) []models.Color {
+	small := image.NewNRGBA(image.Rect(0, 0, paletteSampleSize, paletteSampleSize))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var pixels [][3]int
+	for i := 0; i < len(small.Pix); i += 4 {
+		if small.Pix[i+3] < 128 {
+			continue
+		}
+		pixels = append(pixels, [3]int{int(small.Pix[i]), int(small.Pix[i+1]), int(small.Pix[i+2])})
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	// count the pixels in buckets of 16 levels per channel
+	type bucket struct {
+		count int
+		sum   [3]int
+	}
+	buckets := make(map[int]*bucket)
+	for _, p := range pixels {
+		key := p[0]>>4<<8 | p[1]>>4<<4 | p[2]>>4
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{}
+			buckets[key] = b
+		}
+		b.count++
+		for c := range p {
+			b.sum[c] += p[c]
+		}
+	}
+	keys := make([]int, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b int) int {
+		if buckets[a].count != buckets[b].count {
+			return buckets[b].count - buckets[a].count
+		}
+		return a - b
+	})
+
+	// the fullest buckets that are far enough apart become the palette
+	var centres [][3]int
+	for _, key := range keys {
+		b := buckets[key]
+		centre := [3]int{b.sum[0] / b.count, b.sum[1] / b.count, b.sum[2] / b.count}
+		if !slices.ContainsFunc(centres, func(other [3]int) bool {
+			return distance(centre, other) < minPaletteDistance
+		}) {
+			centres = append(centres, centre)
+		}
+		if len(centres) == PaletteSize {
+			break
+		}
+	}
+
+	counts := make([]int, len(centres))
+	sums := make([][3]int, len(centres))
+	for _, p := range pixels {
+		nearest := 0
+		for i := range centres {
+			if distance(p, centres[i]) < distance(p, centres[nearest]) {
+				nearest = i
+			}
+		}
+		counts[nearest]++
+		for c := range p {
+			sums[nearest][c] += p[c]
+		}
+	}
+
+	palette := make([]models.Color, 0, len(centres))
+	for i := range centres {
+		if counts[i] == 0 {
+			continue
+		}
+		palette = append(palette, models.Color{
+			R:     uint8(sums[i][0] / counts[i]),
+			G:     uint8(sums[i][1] / counts[i]),
+			B:     uint8(sums[i][2] / counts[i]),
+			Share: float64(counts[i]) / float64(len(pixels)),
+		})
+	}
+	slices.SortStableFunc(palette, func(a, b models.Color) int {
+		switch {
+		case a.Share > b.Share:
+			return -1
+		case a.Share < b.Share:
+			return 1
+		}
+		return 0
+	})
+	return palette
+}
+
+// distance is the squared distance of two RGB colours.
+func distance(a, b [3]int) int {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
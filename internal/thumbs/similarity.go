@@ -0,0 +1,34 @@
+package thumbs
+
+import (
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// DHash computes the difference hash of img: the image is shrunk to 9x8
+// grey pixels, and every bit tells whether a pixel is brighter than its
+// right neighbour. Images that look alike have hashes that differ in few
+// bits, regardless of their size or compression.
+func DHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Distance is the number of bits in which two hashes differ, from 0 for
+// images that look the same to 64.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
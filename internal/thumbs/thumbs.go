@@ -0,0 +1,124 @@
+// Package thumbs turns asset thumbnails into the resized variants that are
+// mirrored to our own storage and served by the webserver.
+package thumbs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif" // thumbnails come as gif, jpeg, png or webp
+	_ "image/jpeg"
+	"image/png"
+	"itchgrep/pkg/models"
+	"regexp"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Widths are the widths of the generated variants, in pixels. The largest
+// matches the thumbnails in itch.io's listings.
+var Widths = []int{160, 315}
+
+// DefaultWidth is the variant the UI shows.
+const DefaultWidth = 315
+
+// Formats of the generated variants, as used in their names.
+const (
+	FormatWebP = "webp"
+	FormatPNG  = "png"
+)
+
+// Variant is a single encoded version of a thumbnail.
+type Variant struct {
+	Name        string // e.g. "<hash>-315.webp"
+	ContentType string
+	Data        []byte
+}
+
+// nameRegexp matches the names VariantName generates.
+var nameRegexp = regexp.MustCompile(`^[0-9a-f]{32}-\d+\.(webp|png)$`)
+
+// Hash identifies a thumbnail by its content.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// VariantName returns the name of a variant of the thumbnail with the given
+// hash.
+func VariantName(hash string, width int, format string) string {
+	return fmt.Sprintf("%s-%d.%s", hash, width, format)
+}
+
+// URL returns the path the webserver serves a variant under.
+func URL(hash string, width int, format string) string {
+	return "/thumbs/" + VariantName(hash, width, format)
+}
+
+// ContentType returns the content type of a variant name, or false if name
+// is not one that VariantName generates.
+func ContentType(name string) (string, bool) {
+	match := nameRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	return "image/" + match[1], true
+}
+
+// Thumbnail is a decoded thumbnail.
+type Thumbnail struct {
+	Hash    string         // see Hash
+	DHash   uint64         // see DHash
+	Palette []models.Color // see Palette
+	img     image.Image
+}
+
+// Decode decodes a downloaded thumbnail.
+func Decode(data []byte) (*Thumbnail, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode thumbnail: %w", err)
+	}
+	return &Thumbnail{Hash: Hash(data), DHash: DHash(img), Palette: Palette(img), img: img}, nil
+}
+
+// Variants encodes the thumbnail in every width and format. Variants are
+// never wider than the original.
+func (t *Thumbnail) Variants() ([]Variant, error) {
+	var variants []Variant
+	for _, width := range Widths {
+		resized := Resize(t.img, width)
+		var webpData, pngData bytes.Buffer
+		if err := nativewebp.Encode(&webpData, resized, nil); err != nil {
+			return nil, fmt.Errorf("failed to encode webp: %w", err)
+		}
+		if err := png.Encode(&pngData, resized); err != nil {
+			return nil, fmt.Errorf("failed to encode png: %w", err)
+		}
+		variants = append(variants,
+			Variant{Name: VariantName(t.Hash, width, FormatWebP), ContentType: "image/webp", Data: webpData.Bytes()},
+			Variant{Name: VariantName(t.Hash, width, FormatPNG), ContentType: "image/png", Data: pngData.Bytes()},
+		)
+	}
+	return variants, nil
+}
+
+// Resize scales img to the given width, keeping its aspect ratio. Images
+// that are not wider than that are only copied.
+func Resize(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	resized := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+	return resized
+}
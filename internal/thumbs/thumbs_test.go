@@ -0,0 +1,108 @@
+package thumbs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/webp"
+)
+
+func testThumbnail(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestVariants(t *testing.T) {
+	data := testThumbnail(t, 630, 500)
+	thumb, err := Decode(data)
+	require.NoError(t, err)
+	hash := thumb.Hash
+	assert.Equal(t, Hash(data), hash)
+	variants, err := thumb.Variants()
+	require.NoError(t, err)
+	require.Len(t, variants, 2*len(Widths))
+
+	for _, variant := range variants {
+		contentType, ok := ContentType(variant.Name)
+		require.True(t, ok, variant.Name)
+		assert.Equal(t, contentType, variant.ContentType)
+	}
+
+	webpVariant := variants[2]
+	assert.Equal(t, VariantName(hash, 315, FormatWebP), webpVariant.Name)
+	img, err := webp.Decode(bytes.NewReader(webpVariant.Data))
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(315, 250), img.Bounds().Size(), "the aspect ratio should be kept")
+}
+
+func TestVariantsDoNotUpscale(t *testing.T) {
+	thumb, err := Decode(testThumbnail(t, 100, 80))
+	require.NoError(t, err)
+	variants, err := thumb.Variants()
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(variants[len(variants)-1].Data))
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(100, 80), img.Bounds().Size())
+}
+
+func TestContentTypeRejectsOtherNames(t *testing.T) {
+	for _, name := range []string{"", "../assets.json", "abc-315.webp", Hash(nil) + "-315.gif"} {
+		_, ok := ContentType(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestDHashIgnoresSize(t *testing.T) {
+	large, err := Decode(testThumbnail(t, 630, 500))
+	require.NoError(t, err)
+	small, err := Decode(testThumbnail(t, 160, 127))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, Distance(large.DHash, small.DHash), 4)
+
+	// the same gradient, mirrored, looks nothing alike
+	img := image.NewNRGBA(image.Rect(0, 0, 630, 500))
+	for x := 0; x < 630; x++ {
+		for y := 0; y < 500; y++ {
+			img.Set(629-x, y, color.NRGBA{R: uint8(x * 255 / 630), G: uint8(y * 255 / 500), B: 128, A: 255})
+		}
+	}
+	assert.Greater(t, Distance(large.DHash, DHash(img)), 20)
+}
+
+func TestPalette(t *testing.T) {
+	// three quarters green, one quarter red, and a transparent stripe
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 120))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 120; y++ {
+			switch {
+			case y >= 100:
+				img.Set(x, y, color.NRGBA{})
+			case x < 150:
+				img.Set(x, y, color.NRGBA{R: 40, G: 160, B: 60, A: 255})
+			default:
+				img.Set(x, y, color.NRGBA{R: 200, G: 30, B: 30, A: 255})
+			}
+		}
+	}
+
+	palette := Palette(img)
+	require.Len(t, palette, 2)
+	assert.Equal(t, "#28a03c", palette[0].Hex())
+	assert.InDelta(t, 0.75, palette[0].Share, 0.02)
+	assert.Equal(t, "#c81e1e", palette[1].Hex())
+	assert.InDelta(t, 0.25, palette[1].Share, 0.02)
+
+	assert.Empty(t, Palette(image.NewNRGBA(image.Rect(0, 0, 10, 10))))
+}
@@ -1,11 +1,18 @@
 package web
 
 import (
+	"encoding/json"
+	"errors"
 	"itchgrep/internal/cache"
 	"itchgrep/internal/logging"
+	"itchgrep/internal/storage"
+	"itchgrep/internal/thumbs"
 	"itchgrep/internal/web/templates"
+	"itchgrep/pkg/models"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -33,7 +40,7 @@ func (h *handler) HandleIndex(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		handle404(w, r)
 	} else {
-		component := templates.Layout("ITCHGREP", templates.Index())
+		component := templates.Layout("ITCHGREP", templates.Index(h.cache.Facets()))
 		component.Render(r.Context(), w)
 	}
 }
@@ -56,9 +63,70 @@ func (h *handler) HandleGetAssetPage(w http.ResponseWriter, r *http.Request) {
 	component.Render(r.Context(), w)
 }
 
+// parseFilters reads the search filters from the form values of r. Lists are
+// comma separated, so that they survive being passed on to the next page.
+func parseFilters(r *http.Request) cache.Filters {
+	var filters cache.Filters
+	for _, facet := range strings.Split(r.FormValue("facets"), ",") {
+		if facet = strings.TrimSpace(facet); facet != "" {
+			filters.Facets = append(filters.Facets, facet)
+		}
+	}
+	filters.Free = r.FormValue("free") == "on"
+	filters.OnSale = r.FormValue("sale") == "on"
+	if maxPrice, err := strconv.ParseFloat(r.FormValue("max_price"), 64); err == nil && maxPrice > 0 {
+		filters.MaxPriceCents = int64(maxPrice*100 + 0.5)
+	}
+	if r.FormValue("by_color") == "on" {
+		if color, ok := parseHexColor(r.FormValue("color")); ok {
+			filters.Color = &color
+		}
+	}
+	return filters
+}
+
+// parseHexColor parses colours as sent by a colour input, e.g. "#1a2b3c".
+func parseHexColor(value string) (models.Color, bool) {
+	var color models.Color
+	if len(value) != 7 || value[0] != '#' {
+		return color, false
+	}
+	rgb, err := strconv.ParseUint(value[1:], 16, 32)
+	if err != nil {
+		return color, false
+	}
+	color.R, color.G, color.B = uint8(rgb>>16), uint8(rgb>>8), uint8(rgb)
+	return color, true
+}
+
+// queryVals encodes a query and its filters as the hx-vals of the request
+// for the next page of results.
+func queryVals(query string, filters cache.Filters) string {
+	vals := map[string]string{
+		"query":  query,
+		"facets": strings.Join(filters.Facets, ","),
+	}
+	if filters.Free {
+		vals["free"] = "on"
+	}
+	if filters.OnSale {
+		vals["sale"] = "on"
+	}
+	if filters.MaxPriceCents > 0 {
+		vals["max_price"] = strconv.FormatFloat(float64(filters.MaxPriceCents)/100, 'f', 2, 64)
+	}
+	if filters.Color != nil {
+		vals["by_color"] = "on"
+		vals["color"] = filters.Color.Hex()
+	}
+	encoded, _ := json.Marshal(vals)
+	return string(encoded)
+}
+
 func (h *handler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 	query := r.FormValue("query")
-	if query == "" {
+	filters := parseFilters(r)
+	if query == "" && filters.IsEmpty() {
 		// this shouldn't happen as long as the form is set up correctly
 		http.Error(w, "Empty Query", http.StatusBadRequest)
 		return
@@ -71,17 +139,83 @@ func (h *handler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	assets, err := h.cache.QueryCache(query, pageNum)
+	assets, err := h.cache.QueryCache(query, filters, pageNum)
 	if err != nil {
 		logging.Error("Error searching: %s", err)
 		http.Error(w, "Error searching", http.StatusBadRequest)
 		return
 	}
 
-	component := templates.AssetPage(pageNum, assets, true, query)
+	component := templates.AssetPage(pageNum, assets, true, queryVals(query, filters))
 	component.Render(r.Context(), w)
 }
 
+// similarLimit is the number of assets HandleSimilar shows.
+const similarLimit = 36
+
+// HandleSimilar lists the assets whose thumbnails look like the one of the
+// asset with the given id. Ids are passed as a query parameter, since the
+// ids of other sources contain slashes.
+func (h *handler) HandleSimilar(w http.ResponseWriter, r *http.Request) {
+	gameId := r.FormValue("id")
+	assets, err := h.cache.Similar(gameId, similarLimit)
+	if err != nil {
+		logging.Error("Error finding assets similar to %s: %s", gameId, err)
+		http.Error(w, "Error finding similar assets", http.StatusBadRequest)
+		return
+	}
+
+	component := templates.SimilarAssets(assets)
+	component.Render(r.Context(), w)
+}
+
+// newAssetsWindow is how far back HandleNew looks for new assets, and
+// newAssetsLimit how many of them it shows.
+const (
+	newAssetsWindow = 7 * 24 * time.Hour
+	newAssetsLimit  = 240
+)
+
+// HandleNew lists the assets that appeared in the last week, along with what
+// the last refresh changed.
+func (h *handler) HandleNew(w http.ResponseWriter, r *http.Request) {
+	assets, err := h.cache.NewAssets(time.Now().Add(-newAssetsWindow), newAssetsLimit)
+	if err != nil {
+		logging.Error("Error finding new assets: %s", err)
+		http.Error(w, "Error finding new assets", http.StatusInternalServerError)
+		return
+	}
+
+	component := templates.NewAssets(assets, h.cache.Changes())
+	component.Render(r.Context(), w)
+}
+
+// HandleThumb serves a mirrored thumbnail variant. Their names change with
+// their content, so they can be cached forever.
+func (h *handler) HandleThumb(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	contentType, ok := thumbs.ContentType(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, _, err := storage.GetThumb(r.Context(), name)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.Error("Error fetching thumbnail %s: %s", name, err)
+		http.Error(w, "Error fetching thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(data)
+}
+
 func (h *handler) HandleAbout(w http.ResponseWriter, r *http.Request) {
 	component := templates.About()
 	component.Render(r.Context(), w)
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Changes is what changed in the catalogue between two snapshots, stored
+// next to the newer one.
+type Changes struct {
+	SnapshotId         string
+	PreviousSnapshotId string
+	ComputedAt         time.Time
+
+	Added   []AssetRef
+	Removed []AssetRef
+	Edited  []AssetEdit
+}
+
+// AssetRef names an asset in Changes.
+type AssetRef struct {
+	GameId string
+	Title  string
+	Author string
+	Link   string
+}
+
+// AssetEdit lists the fields of an asset that changed between two snapshots.
+type AssetEdit struct {
+	AssetRef // as in the newer snapshot
+	Fields   []FieldChange
+}
+
+// FieldChange is a single edited field of an asset.
+type FieldChange struct {
+	Field string // "Title", "Author" or "Description"
+	Old   string
+	New   string
+}
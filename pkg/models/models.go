@@ -1,17 +1,78 @@
 package models
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Asset represents a game asset.
 // Assets are stored in the DynamoDB table.
 type Asset struct {
-	GameId        string
+	GameId        string // unique across sources, prefixed with the source name for every source but itch.io
+	Source        string `json:",omitempty"` // the name of the catalogue the asset was crawled from, empty means itch.io
 	Title         string
 	Author        string
 	Description   string
 	Link          string
 	ThumbUrl      string
 	InvPopularity int64 // inverse popularity, derived from page number of the asset
+
+	// the time of the first snapshot the asset was in, see Changes. Nil for
+	// assets of the first snapshot, which has nothing to compare to.
+	FirstSeenAt *time.Time `json:",omitempty"`
+
+	// only set if the thumbnail was mirrored to our own storage, see
+	// package thumbs
+	ThumbHash        string `json:",omitempty"` // identifies the thumbnail by its content
+	MirroredThumbUrl string `json:",omitempty"` // the default variant, as served by the webserver
+
+	// the difference hash of the thumbnail, to find visually similar
+	// assets with. Zero if it was not computed.
+	PerceptualHash uint64 `json:",omitempty"`
+
+	// the dominant colours of the thumbnail, the most common first. Empty if
+	// they were not extracted.
+	Palette []Color `json:",omitempty"`
+
+	// the price as shown in the listing, or on the asset page when details
+	// are crawled, in hundredths of Currency. Free assets include those where
+	// buyers name their own price.
+	Free            bool
+	PriceCents      int64  `json:",omitempty"` // after any discount
+	Currency        string `json:",omitempty"` // ISO 4217 code, e.g. "USD"
+	DiscountPercent int64  `json:",omitempty"` // set while the asset is on sale
+
+	// the itch.io listing facets the asset appeared under in the last full
+	// crawl, e.g. "free" or "tag-pixel-art"
+	Facets []string `json:",omitempty"`
+
+	// The following fields are only filled when the detail crawl stage is
+	// enabled, since it requires fetching every asset page individually.
+	Tags            []string    `json:",omitempty"`
+	License         string      `json:",omitempty"`
+	Files           []AssetFile `json:",omitempty"`
+	Rating          float64     `json:",omitempty"` // average rating out of 5
+	RatingCount     int64       `json:",omitempty"`
+	PublishedAt     *time.Time  `json:",omitempty"`
+	UpdatedAt       *time.Time  `json:",omitempty"`
+	FullDescription string      `json:",omitempty"`
+}
+
+// AssetFile is a downloadable file listed on an asset page.
+type AssetFile struct {
+	Name string
+	Size string // as displayed on the asset page, e.g. "2 MB"
+}
+
+// Color is one of the dominant colours of a thumbnail.
+type Color struct {
+	R, G, B uint8
+	Share   float64 // the fraction of the thumbnail's opaque pixels closest to this colour
+}
+
+// Hex returns the colour in CSS notation, e.g. "#1a2b3c".
+func (c Color) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
 }
 
 func (a Asset) String() string {
@@ -20,13 +81,20 @@ func (a Asset) String() string {
 
 // IndexedAsset is a smaller version of Asset, used for indexing.
 type IndexedAsset struct {
-	GameId        string
-	Title         string
-	Author        string
-	Description   string
-	InvPopularity int64
+	GameId          string
+	Title           string
+	Author          string
+	Description     string
+	Tags            []string
+	Facets          []string
+	Free            bool
+	PriceCents      int64
+	Currency        string
+	DiscountPercent int64
+	ColorBins       []string
+	InvPopularity   int64
 }
 
 func (a IndexedAsset) String() string {
-	return fmt.Sprintf("GameId: %s, Title: %s, Author: %s, Description: %s, InvPopularity: %d", a.GameId, a.Title, a.Author, a.Description, a.InvPopularity)
+	return fmt.Sprintf("GameId: %s, Title: %s, Author: %s, Description: %s, Tags: %v, Facets: %v, InvPopularity: %d", a.GameId, a.Title, a.Author, a.Description, a.Tags, a.Facets, a.InvPopularity)
 }
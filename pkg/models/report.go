@@ -0,0 +1,97 @@
+package models
+
+import "time"
+
+// CrawlReport summarizes a single crawl of the dataservice, so that every
+// stored snapshot can be audited for missing pages.
+type CrawlReport struct {
+	RunId           string
+	Mode            string    // "full" or "incremental"
+	LastFullCrawlAt time.Time // when the full crawl this snapshot builds on ran
+	StartedAt       time.Time
+	FinishedAt      time.Time
+	DurationSeconds float64
+
+	PagesTotal     int64
+	PagesAttempted int64
+	PagesSucceeded int64
+	PagesFailed    int64
+	PagesResumed   int64  // pages taken over from the checkpoint of an earlier attempt
+	ResumedFrom    string `json:",omitempty"` // the run whose checkpoint was resumed
+	AssetCount     int64
+
+	// how long a single page took, including retries
+	AvgPageSeconds float64
+	MaxPageSeconds float64
+
+	FailuresByKind map[string]int64
+	Failures       []PageFailure
+
+	// parser drift detection, see fetcher.DriftThresholds
+	FillRates         FillRates
+	FillRatesBySource map[string]FillRates `json:",omitempty"`
+	EmptyPages        []PageRef            `json:",omitempty"` // pages that parsed into no assets at all
+	LowFillPages      []PageRef            `json:",omitempty"` // pages with fill rates below the warning thresholds
+	DriftWarnings     []string             `json:",omitempty"`
+	DriftFailures     []string             `json:",omitempty"`
+
+	// only set if the detail crawl stage ran
+	DetailsAttempted     int64            `json:",omitempty"`
+	DetailsFailed        int64            `json:",omitempty"`
+	DetailFailuresByKind map[string]int64 `json:",omitempty"`
+
+	// only set if thumbnails were mirrored or hashed
+	ThumbsProcessed     int64            `json:",omitempty"`
+	ThumbsReused        int64            `json:",omitempty"` // taken over from the previous snapshot
+	ThumbsFailed        int64            `json:",omitempty"`
+	ThumbFailuresByKind map[string]int64 `json:",omitempty"`
+}
+
+// PageRef identifies a listing page of a source.
+type PageRef struct {
+	Source string
+	Page   int64
+}
+
+// PageFailure describes why a single listing page is missing from a crawl.
+type PageFailure struct {
+	Source          string
+	Page            int64
+	Kind            string
+	Reason          string
+	DurationSeconds float64
+}
+
+// CrawlCheckpoint is the persisted progress of an unfinished crawl, from which
+// a later run can resume instead of starting over.
+type CrawlCheckpoint struct {
+	RunId     string
+	Mode      string
+	StartedAt time.Time
+	UpdatedAt time.Time
+
+	Sources      map[string]*SourceProgress // by source name
+	FacetMembers map[string][]string        `json:",omitempty"` // the GameIds found under each facet listing
+
+	// the number of parts the assets written so far are stored in, next to
+	// the checkpoint. They include every asset of the completed pages.
+	AssetParts int
+}
+
+// SourceProgress is the part of a CrawlCheckpoint that concerns one source.
+type SourceProgress struct {
+	PagesTotal     int64
+	CompletedPages []int64
+}
+
+// FillRates is the share of assets, between 0 and 1, that have each listing
+// field set. A sudden drop means a source changed its markup.
+type FillRates struct {
+	Assets      int64
+	GameId      float64
+	Title       float64
+	Author      float64
+	Description float64
+	Link        float64
+	ThumbUrl    float64
+}
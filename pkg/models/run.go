@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// States of a Run.
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+)
+
+// Run is the state of a single crawl of the dataservice, as served by its
+// /runs endpoints. Runs are only kept in memory, the crawl report is what
+// remains of them.
+type Run struct {
+	Id         string
+	Mode       string // as requested, Progress.Mode is the mode that actually ran
+	Trigger    string // what started the run, e.g. "http" or "schedule"
+	State      string
+	Error      string `json:",omitempty"` // why the run failed or was cancelled
+	StartedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+
+	// the counters of the crawl report so far, see
+	// fetcher.ReportRecorder.Progress
+	Progress CrawlReport
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Manifest names the snapshot that is currently served. It is written after
+// every object of the snapshot, so that readers see either the complete old
+// or the complete new snapshot, never a mix of both.
+type Manifest struct {
+	SnapshotId  string // the ID of the run that wrote the snapshot
+	PublishedAt time.Time
+	AssetCount  int
+}
+
+// Snapshot describes a stored snapshot, as listed by the dataservice.
+type Snapshot struct {
+	Id      string
+	Current bool // whether the manifest points at it
+
+	// Complete is false for snapshots whose upload never finished, which
+	// can not be rolled back to. The fields below are taken from the crawl
+	// report and are only set for complete snapshots.
+	Complete   bool
+	Mode       string `json:",omitempty"`
+	FinishedAt time.Time
+	AssetCount int64
+}